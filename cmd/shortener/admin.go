@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+func registerAdmin(r chi.Router, st db.Storage, token string) {
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(adminAuth(token))
+		if cached, ok := st.(*db.CachedStorage); ok {
+			r.Get("/cache", func(w http.ResponseWriter, r *http.Request) {
+				resp, err := json.Marshal(cached.Stats())
+				if err != nil {
+					http.Error(w, "Server error", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Write(resp)
+			})
+		}
+	})
+}
+
+func adminAuth(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/backup"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"io"
+	"log"
+	"os"
+)
+
+var (
+	errNoNativeBackup   = errors.New("storage has no native backup format")
+	errInProcessStorage = errors.New("backup and restore need a storage outside the server process: a database, redis or BOLT_PATH")
+)
+
+type nativeBackuper interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+func runBackup(cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := fs.String("o", "-", "archive path, - for stdout")
+	native := fs.Bool("native", false, "write the storage's own database file instead of a portable archive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if inProcessStorage(cfg) {
+		return errInProcessStorage
+	}
+
+	st, dbs, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(st, dbs)
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *native {
+		var nb nativeBackuper
+		for _, layer := range db.Layers(st) {
+			if b, ok := layer.(nativeBackuper); ok {
+				nb = b
+			}
+		}
+		if nb == nil {
+			return errNoNativeBackup
+		}
+		n, err := nb.Backup(w)
+		if err != nil {
+			return err
+		}
+		log.Printf("backup finished: %d bytes", n)
+		return nil
+	}
+
+	manifest, err := backup.Write(context.Background(), st, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("backup finished: %d links, sha256 %s", manifest.Count, manifest.SHA256)
+	return nil
+}
+
+func runRestore(cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := fs.String("i", "", "archive path")
+	policy := fs.String("on-conflict", string(backup.PolicyFail), "id collision policy: skip, overwrite or fail")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if inProcessStorage(cfg) {
+		return errInProcessStorage
+	}
+
+	st, dbs, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(st, dbs)
+
+	result, err := restoreFile(context.Background(), st, *input, backup.Policy(*policy))
+	if err != nil {
+		return err
+	}
+	log.Printf("restore finished: %d restored, %d overwritten, %d skipped", result.Restored, result.Overwritten, result.Skipped)
+	return nil
+}
+
+func restoreFile(ctx context.Context, st db.Storage, path string, policy backup.Policy) (backup.RestoreResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return backup.RestoreResult{}, err
+	}
+	defer file.Close()
+
+	if _, err := backup.Verify(file); err != nil {
+		return backup.RestoreResult{}, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return backup.RestoreResult{}, err
+	}
+	return backup.Restore(ctx, st, file, policy)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"log"
+	"os"
+	"strings"
+)
+
+// cutoverSuffix is appended to FILE_STORAGE_PATH on cutover. Once the old
+// log has been retired, STORAGE_MIGRATION serves from the new storage only.
+const cutoverSuffix = ".migrated"
+
+var errNotMigrating = errors.New("cutover requires STORAGE_MIGRATION")
+
+func cutOver(cfg *Config) bool {
+	_, err := os.Stat(cfg.FileStoragePath + cutoverSuffix)
+	return err == nil
+}
+
+func backfill(st *db.MigratingStorage) {
+	err := st.Backfill(context.Background(), logProgress)
+	if err != nil {
+		log.Printf("backfill failed: %v", err)
+		return
+	}
+	log.Println("backfill finished")
+}
+
+// runCutover backfills and verifies the new storage, then retires the old
+// file log, so servers started with STORAGE_MIGRATION stop dual writing.
+func runCutover(cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("cutover", flag.ExitOnError)
+	allowConflicts := fs.Bool("allow-conflicts", false, "cut over even if links whose URL is shortened under another ID could not be copied")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cutOver(cfg) {
+		log.Printf("%s was already cut over", cfg.FileStoragePath)
+		return nil
+	}
+
+	result, err := backfillAndVerify(cfg)
+	if err != nil {
+		return err
+	}
+	if len(result.Missing) > 0 || len(result.Mismatched) > 0 || (len(result.Conflicts) > 0 && !*allowConflicts) {
+		return fmt.Errorf("parity not confirmed: %d checked, %d missing, %d mismatched, %d conflicting",
+			result.Checked, len(result.Missing), len(result.Mismatched), len(result.Conflicts))
+	}
+	if len(result.Conflicts) > 0 {
+		log.Printf("not copied, URL shortened under another ID: %s", strings.Join(result.Conflicts, ", "))
+	}
+
+	if err := os.Rename(cfg.FileStoragePath, cfg.FileStoragePath+cutoverSuffix); err != nil {
+		return err
+	}
+	log.Printf("cut over %d links; old log kept as %s, restart servers to stop dual writes", result.Checked, cfg.FileStoragePath+cutoverSuffix)
+	return nil
+}
+
+func backfillAndVerify(cfg *Config) (db.VerifyResult, error) {
+	st, dbs, err := openStorage(cfg)
+	if err != nil {
+		return db.VerifyResult{}, err
+	}
+	defer closeStorage(st, dbs)
+
+	var migrating *db.MigratingStorage
+	for _, layer := range db.Layers(st) {
+		if m, ok := layer.(*db.MigratingStorage); ok {
+			migrating = m
+		}
+	}
+	if migrating == nil {
+		return db.VerifyResult{}, errNotMigrating
+	}
+
+	ctx := context.Background()
+	if err := migrating.Backfill(ctx, logProgress); err != nil {
+		return db.VerifyResult{}, err
+	}
+	return migrating.Verify(ctx)
+}
+
+func logProgress(p db.MigrationProgress) {
+	log.Printf("backfill: %d/%d scanned, %d copied, %d conflicting", p.Scanned, p.Total, p.Copied, p.Conflicts)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"github.com/Vrg26/shortener-tpl/internal/app/middlewares"
 	"github.com/Vrg26/shortener-tpl/internal/app/shorturl"
@@ -14,17 +15,61 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/jackc/pgx"
 	_ "github.com/lib/pq"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
+var errInvalidSecretKey = errors.New("SECRET_KEYS entries must be id:secret")
+
 type Config struct {
 	ServerAddress   string `env:"SERVER_ADDRESS" envDefault:":8080"`
 	BaseURL         string `env:"BASE_URL" envDefault:"http://localhost:8080"`
 	FileStoragePath string `env:"FILE_STORAGE_PATH"`
 	SecretKey       string `env:"SECRET_KEY" envDefault:"secret key"`
 	DataBaseDSN     string `env:"DATABASE_DSN"`
+
+	DataBaseShards      []string      `env:"DATABASE_SHARDS" envSeparator:","`
+	FileStorageShards   []string      `env:"FILE_STORAGE_SHARDS" envSeparator:","`
+	FileStorageFsync    bool          `env:"FILE_STORAGE_FSYNC"`
+	FileCompactInterval time.Duration `env:"FILE_STORAGE_COMPACT_INTERVAL" envDefault:"10m"`
+	StorageMigration    bool          `env:"STORAGE_MIGRATION"`
+	AdminToken          string        `env:"ADMIN_TOKEN"`
+	BoltPath            string        `env:"BOLT_PATH"`
+	RedisURL            string        `env:"REDIS_URL"`
+	RedisMode           string        `env:"REDIS_MODE" envDefault:"storage"`
+	RedisCacheTTL       time.Duration `env:"REDIS_CACHE_TTL" envDefault:"1h"`
+	CacheSize           int           `env:"CACHE_SIZE"`
+	CacheTTL            time.Duration `env:"CACHE_TTL" envDefault:"5m"`
+	CacheNegativeTTL    time.Duration `env:"CACHE_NEGATIVE_TTL" envDefault:"10s"`
+
+	IDGenerator    string `env:"ID_GENERATOR" envDefault:"random"`
+	IDAlphabet     string `env:"ID_ALPHABET" envDefault:"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"`
+	IDLength       int    `env:"ID_LENGTH" envDefault:"7"`
+	IDSalt         string `env:"ID_SALT"`
+	IDCounterStart uint64 `env:"ID_COUNTER_START"`
+
+	EncryptionKeys []string `env:"ENCRYPTION_KEYS" envSeparator:","`
+
+	SecretKeys         []string      `env:"SECRET_KEYS" envSeparator:","`
+	AuthCookieMaxAge   time.Duration `env:"AUTH_COOKIE_MAX_AGE" envDefault:"720h"`
+	LegacyCookiesUntil time.Time     `env:"LEGACY_COOKIES_UNTIL"`
+
+	KeyPoolSize     int    `env:"KEY_POOL_SIZE"`
+	KeyPoolLowWater int    `env:"KEY_POOL_LOW_WATER" envDefault:"2000"`
+	KeyPoolPath     string `env:"KEY_POOL_PATH"`
+
+	ClickFlushInterval time.Duration `env:"CLICK_FLUSH_INTERVAL" envDefault:"10s"`
+	BatchMaxSize       int           `env:"BATCH_MAX_SIZE" envDefault:"1000"`
+	PreviewFetchTitles bool          `env:"PREVIEW_FETCH_TITLES"`
+
+	MemorySnapshotPath     string        `env:"MEMORY_SNAPSHOT_PATH"`
+	MemorySnapshotInterval time.Duration `env:"MEMORY_SNAPSHOT_INTERVAL" envDefault:"1m"`
 }
 
 func main() {
@@ -40,7 +85,32 @@ func main() {
 
 	flag.Parse()
 
-	log.Fatal(runServer(&cfg))
+	switch flag.Arg(0) {
+	case "rebalance":
+		if err := runRebalance(&cfg); err != nil {
+			log.Fatal(err)
+		}
+	case "cutover":
+		if err := runCutover(&cfg, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "backup":
+		if err := runBackup(&cfg, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "restore":
+		if err := runRestore(&cfg, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "reencrypt":
+		if err := runReencrypt(&cfg); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		if err := runServer(&cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func runServer(cfg *Config) error {
@@ -49,54 +119,121 @@ func runServer(cfg *Config) error {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middlewares.Auth(cfg.ServerAddress))
+	keys, err := authKeys(cfg)
+	if err != nil {
+		return err
+	}
+	r.Use(middlewares.Auth(keys, cfg.AuthCookieMaxAge, strings.HasPrefix(cfg.BaseURL, "https://")))
 	r.Use(middlewares.Gzip)
 
-	var service *shorturl.Service
+	st, dbs, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeAll(dbs)
+	if len(dbs) > 0 {
+		r.Get("/ping", PingDB(dbs...))
+	}
 
-	switch {
-	case cfg.DataBaseDSN != "":
-		{
-			dbPostgres, err := sql.Open("postgres", cfg.DataBaseDSN)
+	for _, layer := range db.Layers(st) {
+		if migrating, ok := layer.(*db.MigratingStorage); ok {
+			go backfill(migrating)
+		}
+	}
 
-			if err != nil {
-				return err
-			}
-			defer dbPostgres.Close()
+	listenCtx, cancelListen := context.WithCancel(context.Background())
+	defer cancelListen()
+	if cache, ok := st.(*db.CachedStorage); ok {
+		for _, dsn := range postgresDSNs(cfg) {
+			go listenInvalidations(listenCtx, dsn, cache)
+		}
+	}
 
-			r.Get("/ping", PingDB(dbPostgres))
+	if cfg.AdminToken != "" {
+		registerAdmin(r, st, cfg.AdminToken)
+	}
 
-			st := db.NewPostgresStorage(dbPostgres)
+	service := shorturl.NewService(st)
+	clicks := db.NewClickBuffer(st, cfg.ClickFlushInterval)
+	service.SetClickBuffer(clicks)
+	var titles *shorturl.TitleFetcher
+	if cfg.PreviewFetchTitles {
+		titles = shorturl.NewTitleFetcher(st)
+		service.SetTitleFetcher(titles)
+	}
 
-			if err := st.MigrateUp("file://migrations"); err != nil {
-				return err
-			}
+	handler := shorturl.NewHandler(*service, cfg.BaseURL)
+	handler.SetMaxBatchSize(cfg.BatchMaxSize)
+	handler.Register(r)
 
-			service = shorturl.NewService(st)
-		}
-	case cfg.FileStoragePath != "":
-		{
-			st := db.NewFileStorage(cfg.FileStoragePath)
-			service = shorturl.NewService(st)
+	srv := &http.Server{Addr: cfg.ServerAddress, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println(err)
 		}
-	default:
-		{
-			st := db.NewMemoryStorage()
-			service = shorturl.NewService(st)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	importsCtx, cancelImports := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelImports()
+	if err := handler.Shutdown(importsCtx); err != nil {
+		log.Println(err)
+	}
+	if titles != nil {
+		titles.Close()
+	}
+	if err := clicks.Close(); err != nil {
+		log.Println(err)
+	}
+	if closer, ok := st.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// authKeys reads SECRET_KEYS as "id:secret" pairs, newest first, and falls
+// back to SECRET_KEY. Before LEGACY_COOKIES_UNTIL the server address, which
+// signed cookies before SECRET_KEY was used, verifies those cookies too.
+func authKeys(cfg *Config) ([]middlewares.AuthKey, error) {
+	keys := []middlewares.AuthKey{{ID: "0", Secret: []byte(cfg.SecretKey)}}
+	if len(cfg.SecretKeys) > 0 {
+		keys = make([]middlewares.AuthKey, len(cfg.SecretKeys))
+		for index, value := range cfg.SecretKeys {
+			parts := strings.SplitN(value, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 || parts[1] == "" {
+				return nil, errInvalidSecretKey
+			}
+			keys[index] = middlewares.AuthKey{ID: parts[0], Secret: []byte(parts[1])}
 		}
 	}
+	if !cfg.LegacyCookiesUntil.IsZero() {
+		keys = append(keys, middlewares.AuthKey{Secret: []byte(cfg.ServerAddress), LegacyUntil: cfg.LegacyCookiesUntil})
+	}
+	return keys, nil
+}
 
-	handler := shorturl.NewHandler(*service, cfg.BaseURL)
-	handler.Register(r)
-	return http.ListenAndServe(cfg.ServerAddress, r)
+func listenInvalidations(ctx context.Context, dsn string, cache *db.CachedStorage) {
+	if err := db.ListenInvalidations(ctx, dsn, cache); err != nil {
+		log.Println(err)
+	}
 }
 
-func PingDB(db *sql.DB) http.HandlerFunc {
+func PingDB(dbs ...*sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := db.PingContext(ctx); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		for _, db := range dbs {
+			if err := db.PingContext(ctx); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		}
 
 		w.WriteHeader(http.StatusOK)
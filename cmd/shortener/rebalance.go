@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"log"
+)
+
+var errNotSharded = errors.New("rebalance requires DATABASE_SHARDS or FILE_STORAGE_SHARDS")
+
+func runRebalance(cfg *Config) error {
+	st, dbs, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(st, dbs)
+
+	var sharded *db.ShardedStorage
+	for _, layer := range db.Layers(st) {
+		if s, ok := layer.(*db.ShardedStorage); ok {
+			sharded = s
+		}
+	}
+	if sharded == nil {
+		return errNotSharded
+	}
+
+	moved, err := sharded.Rebalance(context.Background(), func(shard string, moved int) {
+		log.Printf("shard %s: moved %d links", shard, moved)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("rebalance finished: %d links moved", moved)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"log"
+)
+
+var errNotEncrypted = errors.New("reencrypt requires ENCRYPTION_KEYS")
+
+func runReencrypt(cfg *Config) error {
+	st, dbs, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(st, dbs)
+
+	var encrypted *db.EncryptedStorage
+	for _, layer := range db.Layers(st) {
+		if e, ok := layer.(*db.EncryptedStorage); ok {
+			encrypted = e
+		}
+	}
+	if encrypted == nil {
+		return errNotEncrypted
+	}
+
+	rewritten, err := encrypted.Reencrypt(context.Background(), func(rewritten int) {
+		log.Printf("reencrypt: %d links rewritten", rewritten)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("reencrypt finished: %d links rewritten", rewritten)
+	return nil
+}
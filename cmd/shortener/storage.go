@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"log"
+	_ "modernc.org/sqlite"
+	"strings"
+)
+
+var (
+	errNoMigrationSource    = errors.New("storage migration requires FILE_STORAGE_PATH")
+	errNoMigrationTarget    = errors.New("storage migration requires DATABASE_DSN or DATABASE_SHARDS")
+	errUnknownGenerator     = errors.New("unknown ID_GENERATOR")
+	errSharedCounter        = errors.New("ID_GENERATOR keeps its sequence in memory, so it cannot be used with storage shared by several instances")
+	errNoKeyStore           = errors.New("key pool requires a SQL storage or KEY_POOL_PATH")
+	errInvalidEncryptionKey = errors.New("ENCRYPTION_KEYS entries must be id:base64 secret")
+)
+
+const redisModeCache = "cache"
+
+type idConfigurable interface {
+	SetIDGenerator(gen db.IDGenerator)
+}
+
+type keyStoreProvider interface {
+	KeyStore() db.KeyStore
+}
+
+func openStorage(cfg *Config) (db.Storage, []*sql.DB, error) {
+	gen, err := newIDGenerator(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, dbs, err := openBackend(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.SeedIDGenerator(context.Background(), gen, st); err != nil {
+		closeStorage(st, dbs)
+		return nil, nil, err
+	}
+	if cfg.KeyPoolSize > 0 {
+		store, err := openKeyStore(cfg, st)
+		if err != nil {
+			closeStorage(st, dbs)
+			return nil, nil, err
+		}
+		gen, err = db.NewKeyPool(store, gen, cfg.KeyPoolSize, cfg.KeyPoolLowWater)
+		if err != nil {
+			closeStorage(st, dbs)
+			return nil, nil, err
+		}
+	}
+	if configurable, ok := st.(idConfigurable); ok {
+		configurable.SetIDGenerator(gen)
+	}
+
+	if cfg.RedisURL != "" && cfg.RedisMode == redisModeCache {
+		client, err := openRedis(cfg.RedisURL)
+		if err != nil {
+			closeStorage(st, dbs)
+			return nil, nil, err
+		}
+		st = db.NewRedisCache(client, st, cfg.RedisCacheTTL)
+	}
+	if len(cfg.EncryptionKeys) > 0 {
+		keys, err := parseEncryptionKeys(cfg.EncryptionKeys)
+		if err != nil {
+			closeStorage(st, dbs)
+			return nil, nil, err
+		}
+		encrypted, err := db.NewEncryptedStorage(st, keys...)
+		if err != nil {
+			closeStorage(st, dbs)
+			return nil, nil, err
+		}
+		st = encrypted
+	}
+	if cfg.CacheSize > 0 {
+		st = db.NewCachedStorage(st, cfg.CacheSize, cfg.CacheTTL, cfg.CacheNegativeTTL)
+	}
+	return st, dbs, nil
+}
+
+// parseEncryptionKeys reads "id:base64 secret" pairs, current key first.
+func parseEncryptionKeys(values []string) ([]db.EncryptionKey, error) {
+	keys := make([]db.EncryptionKey, len(values))
+	for index, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: %q", errInvalidEncryptionKey, parts[0])
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errInvalidEncryptionKey, parts[0])
+		}
+		keys[index] = db.EncryptionKey{ID: parts[0], Secret: secret}
+	}
+	return keys, nil
+}
+
+func newIDGenerator(cfg *Config) (db.IDGenerator, error) {
+	if (cfg.IDGenerator == "counter" || cfg.IDGenerator == "hashids") && sharedStorage(cfg) {
+		return nil, fmt.Errorf("%w: %s", errSharedCounter, cfg.IDGenerator)
+	}
+	switch cfg.IDGenerator {
+	case "random":
+		return db.NewRandomIDGenerator(cfg.IDAlphabet, cfg.IDLength)
+	case "counter":
+		return db.NewCounterIDGenerator(cfg.IDAlphabet, cfg.IDCounterStart, cfg.IDLength)
+	case "hashids":
+		return db.NewHashidsIDGenerator(cfg.IDAlphabet, cfg.IDSalt, cfg.IDCounterStart, cfg.IDLength)
+	case "hash":
+		return db.NewHashIDGenerator(cfg.IDAlphabet, cfg.IDLength)
+	}
+	return nil, fmt.Errorf("%w: %q", errUnknownGenerator, cfg.IDGenerator)
+}
+
+func openKeyStore(cfg *Config, st db.Storage) (db.KeyStore, error) {
+	if provider, ok := st.(keyStoreProvider); ok && cfg.KeyPoolPath == "" {
+		return provider.KeyStore(), nil
+	}
+	path := cfg.KeyPoolPath
+	if path == "" && cfg.FileStoragePath != "" {
+		path = cfg.FileStoragePath + ".keys"
+	}
+	if path == "" {
+		return nil, errNoKeyStore
+	}
+	return db.NewFileKeyStore(path, st)
+}
+
+func openBackend(cfg *Config) (db.Storage, []*sql.DB, error) {
+	switch {
+	case cfg.StorageMigration:
+		if cfg.FileStoragePath == "" {
+			return nil, nil, errNoMigrationSource
+		}
+		target := *cfg
+		target.StorageMigration = false
+		target.FileStoragePath = ""
+		if target.DataBaseDSN == "" && len(target.DataBaseShards) == 0 {
+			return nil, nil, errNoMigrationTarget
+		}
+		if cutOver(cfg) {
+			log.Printf("%s was cut over, serving from the new storage only", cfg.FileStoragePath)
+			return openBackend(&target)
+		}
+		from, err := db.NewFileStorage(cfg.FileStoragePath, cfg.FileStorageFsync, cfg.FileCompactInterval)
+		if err != nil {
+			return nil, nil, err
+		}
+		to, dbs, err := openBackend(&target)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db.NewMigratingStorage(from, to), dbs, nil
+	case len(cfg.DataBaseShards) > 0:
+		var dbs []*sql.DB
+		shards := make([]db.Shard, len(cfg.DataBaseShards))
+		for index, dsn := range cfg.DataBaseShards {
+			st, dbConn, err := openSQL(dsn)
+			if err != nil {
+				closeAll(dbs)
+				return nil, nil, err
+			}
+			dbs = append(dbs, dbConn)
+			shards[index] = db.Shard{Name: dsn, Storage: st}
+		}
+		return db.NewShardedStorage(shards...), dbs, nil
+	case len(cfg.FileStorageShards) > 0:
+		shards := make([]db.Shard, len(cfg.FileStorageShards))
+		for index, path := range cfg.FileStorageShards {
+			st, err := db.NewFileStorage(path, cfg.FileStorageFsync, cfg.FileCompactInterval)
+			if err != nil {
+				return nil, nil, err
+			}
+			shards[index] = db.Shard{Name: path, Storage: st}
+		}
+		return db.NewShardedStorage(shards...), nil, nil
+	case cfg.DataBaseDSN != "":
+		st, dbConn, err := openSQL(cfg.DataBaseDSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		return st, []*sql.DB{dbConn}, nil
+	case cfg.RedisURL != "" && cfg.RedisMode != redisModeCache:
+		client, err := openRedis(cfg.RedisURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db.NewRedisStorage(client), nil, nil
+	case cfg.BoltPath != "":
+		st, err := db.NewBoltStorage(cfg.BoltPath)
+		return st, nil, err
+	case cfg.FileStoragePath != "":
+		st, err := db.NewFileStorage(cfg.FileStoragePath, cfg.FileStorageFsync, cfg.FileCompactInterval)
+		return st, nil, err
+	case cfg.MemorySnapshotPath != "":
+		st, err := db.NewMemoryStorageWithSnapshot(cfg.MemorySnapshotPath, cfg.MemorySnapshotInterval)
+		return st, nil, err
+	default:
+		return db.NewMemoryStorage(), nil, nil
+	}
+}
+
+const sqlitePrefix = "sqlite://"
+
+// sharedStorage reports whether several instances may serve from the storage.
+func sharedStorage(cfg *Config) bool {
+	return len(postgresDSNs(cfg)) > 0 || cfg.RedisURL != "" && cfg.RedisMode != redisModeCache
+}
+
+// inProcessStorage reports whether the links live in the server process
+// (memory, a memory snapshot or a file log), where another process can
+// neither see the latest writes nor safely add its own.
+func inProcessStorage(cfg *Config) bool {
+	switch {
+	case cfg.StorageMigration:
+		return !cutOver(cfg)
+	case len(cfg.DataBaseShards) > 0:
+		return false
+	case len(cfg.FileStorageShards) > 0:
+		return true
+	case cfg.DataBaseDSN != "", cfg.RedisURL != "" && cfg.RedisMode != redisModeCache, cfg.BoltPath != "":
+		return false
+	}
+	return true
+}
+
+func postgresDSNs(cfg *Config) []string {
+	var dsns []string
+	for _, dsn := range append([]string{cfg.DataBaseDSN}, cfg.DataBaseShards...) {
+		if dsn != "" && !strings.HasPrefix(dsn, sqlitePrefix) {
+			dsns = append(dsns, dsn)
+		}
+	}
+	return dsns
+}
+
+func openSQL(dsn string) (db.Storage, *sql.DB, error) {
+	driver, newStorage := "postgres", db.NewPostgresStorage
+	isSQLite := strings.HasPrefix(dsn, sqlitePrefix)
+	if isSQLite {
+		driver, newStorage, dsn = "sqlite", db.NewSQLiteStorage, strings.TrimPrefix(dsn, sqlitePrefix)
+	}
+
+	dbConn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isSQLite {
+		dbConn.SetMaxOpenConns(1)
+	}
+
+	st := newStorage(dbConn)
+
+	if err := st.MigrateUp("file://migrations"); err != nil {
+		dbConn.Close()
+		return nil, nil, err
+	}
+	return st, dbConn, nil
+}
+
+func openRedis(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+func closeAll(dbs []*sql.DB) {
+	for _, dbConn := range dbs {
+		dbConn.Close()
+	}
+}
+
+func closeStorage(st db.Storage, dbs []*sql.DB) {
+	if closer, ok := st.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	closeAll(dbs)
+}
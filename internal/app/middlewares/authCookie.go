@@ -5,71 +5,158 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"github.com/Vrg26/shortener-tpl/internal/app/types"
 	"net/http"
+	"time"
 )
 
 const userKey types.ContextKey = 0
 
-func Auth(secretKey string) func(next http.Handler) http.Handler {
+const (
+	cookieName    = "User"
+	cookieVersion = 1
+	signSize      = sha256.Size
+)
+
+var (
+	errInvalidCookie = errors.New("invalid auth cookie")
+	errExpiredCookie = errors.New("expired auth cookie")
+)
+
+var now = time.Now
+
+// AuthKey signs auth cookies. ID is stored in the cookie, so a key can be
+// retired without logging out users whose cookies it signed. A key with
+// LegacyUntil set only verifies the unversioned cookies issued before keys
+// had IDs, and only until then; those cookies are reissued on first use.
+type AuthKey struct {
+	ID          string
+	Secret      []byte
+	LegacyUntil time.Time
+}
+
+type authClaims struct {
+	keyID    string
+	userID   uint32
+	issuedAt time.Time
+}
+
+// Auth identifies users by a signed cookie. Cookies are signed with the first
+// key and verified with any of them. A cookie older than half of maxAge, or
+// signed with an older key, is reissued; a missing, invalid or expired one is
+// replaced with a new identity.
+func Auth(keys []AuthKey, maxAge time.Duration, secure bool) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var id uint32
-			user, err := r.Cookie("User")
+			claims, err := readAuthCookie(r, keys, maxAge)
 			if err != nil {
-				idBytes, err := generateBytesUserID()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
-				user = createAuthCookie(idBytes, secretKey)
-				http.SetCookie(w, user)
-				id = binary.BigEndian.Uint32(idBytes)
-			} else {
-				id, err = decodeAuthCookie(user.Value, secretKey)
+				claims.userID, err = generateUserID()
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					http.Error(w, "Server error", http.StatusInternalServerError)
+					return
 				}
 			}
-			ctx := context.WithValue(r.Context(), userKey, id)
+			if err != nil || claims.keyID != keys[0].ID || now().Sub(claims.issuedAt) > maxAge/2 {
+				http.SetCookie(w, createAuthCookie(claims.userID, keys[0], maxAge, secure))
+			}
+			ctx := context.WithValue(r.Context(), userKey, claims.userID)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func decodeAuthCookie(value string, secretKey string) (uint32, error) {
-	data, err := hex.DecodeString(value)
+func readAuthCookie(r *http.Request, keys []AuthKey, maxAge time.Duration) (authClaims, error) {
+	cookie, err := r.Cookie(cookieName)
 	if err != nil {
-		return 0, err
+		return authClaims{}, err
 	}
+	claims, err := decodeAuthCookie(cookie.Value, keys)
+	if err != nil {
+		return authClaims{}, err
+	}
+	if now().Sub(claims.issuedAt) > maxAge {
+		return authClaims{}, errExpiredCookie
+	}
+	return claims, nil
+}
 
-	id := binary.BigEndian.Uint32(data[:8])
+// decodeAuthCookie accepts the current format and, while a legacy key is
+// valid, the unversioned hex one. Legacy claims have no key ID, so Auth
+// replaces them with a current cookie right away.
+func decodeAuthCookie(value string, keys []AuthKey) (authClaims, error) {
+	if data, err := hex.DecodeString(value); err == nil && len(data) == 8+signSize {
+		for _, key := range keys {
+			if key.LegacyUntil.IsZero() || now().After(key.LegacyUntil) {
+				continue
+			}
+			if hmac.Equal(data[8:], sign(key.Secret, data[:8])) {
+				return authClaims{userID: binary.BigEndian.Uint32(data[:4]), issuedAt: now()}, nil
+			}
+		}
+		return authClaims{}, errInvalidCookie
+	}
 
-	hm := hmac.New(sha256.New, []byte(secretKey))
-	hm.Write(data[:8])
-	sign := hm.Sum(nil)
-	if hmac.Equal(data[8:], sign) {
-		return id, nil
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < 2+4+8+signSize || data[0] != cookieVersion {
+		return authClaims{}, errInvalidCookie
+	}
+	payload, signature := data[:len(data)-signSize], data[len(data)-signSize:]
+	keyLen := int(payload[1])
+	if len(payload) != 2+keyLen+4+8 {
+		return authClaims{}, errInvalidCookie
+	}
+	keyID := string(payload[2 : 2+keyLen])
+	for _, key := range keys {
+		if !key.LegacyUntil.IsZero() || key.ID != keyID {
+			continue
+		}
+		if !hmac.Equal(signature, sign(key.Secret, payload)) {
+			return authClaims{}, errInvalidCookie
+		}
+		rest := payload[2+keyLen:]
+		return authClaims{
+			keyID:    keyID,
+			userID:   binary.BigEndian.Uint32(rest[:4]),
+			issuedAt: time.Unix(int64(binary.BigEndian.Uint64(rest[4:])), 0),
+		}, nil
 	}
-	return 0, http.ErrNoCookie
+	return authClaims{}, errInvalidCookie
 }
 
-func generateBytesUserID() ([]byte, error) {
-	id := make([]byte, 8)
+func generateUserID() (uint32, error) {
+	id := make([]byte, 4)
 
 	if _, err := rand.Read(id); err != nil {
-		return nil, err
+		return 0, err
 	}
-	return id, nil
+	return binary.BigEndian.Uint32(id), nil
 }
 
-func createAuthCookie(id []byte, secretKey string) *http.Cookie {
-	h := hmac.New(sha256.New, []byte(secretKey))
-	h.Write(id)
-	sign := hex.EncodeToString(append(id, h.Sum(nil)...))
+func createAuthCookie(userID uint32, key AuthKey, maxAge time.Duration, secure bool) *http.Cookie {
+	issuedAt := now()
+	payload := []byte{cookieVersion, byte(len(key.ID))}
+	payload = append(payload, key.ID...)
+	payload = append(payload, make([]byte, 12)...)
+	binary.BigEndian.PutUint32(payload[len(payload)-12:], userID)
+	binary.BigEndian.PutUint64(payload[len(payload)-8:], uint64(issuedAt.Unix()))
 	return &http.Cookie{
-		Name:  "User",
-		Value: sign,
+		Name:     cookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(append(payload, sign(key.Secret, payload)...)),
+		Path:     "/",
+		Expires:  issuedAt.Add(maxAge),
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
 	}
 }
+
+func sign(secret, data []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,131 @@
+package middlewares
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	currentKey = AuthKey{ID: "2", Secret: []byte("new secret")}
+	retiredKey = AuthKey{ID: "1", Secret: []byte("old secret")}
+)
+
+func serveAuth(t *testing.T, keys []AuthKey, cookie *http.Cookie) (uint32, *http.Cookie) {
+	var userID uint32
+	handler := Auth(keys, time.Hour, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID = r.Context().Value(userKey).(uint32)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		return userID, nil
+	}
+	return userID, cookies[0]
+}
+
+func withNow(t *testing.T, at time.Time) {
+	now = func() time.Time { return at }
+	t.Cleanup(func() { now = time.Now })
+}
+
+func TestAuth_IssuesHardenedCookie(t *testing.T) {
+	userID, cookie := serveAuth(t, []AuthKey{currentKey}, nil)
+	require.NotNil(t, cookie)
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	assert.Equal(t, "/", cookie.Path)
+	assert.Equal(t, 3600, cookie.MaxAge)
+
+	again, renewed := serveAuth(t, []AuthKey{currentKey}, cookie)
+	assert.Equal(t, userID, again)
+	assert.Nil(t, renewed)
+}
+
+func TestAuth_RotatesKeys(t *testing.T) {
+	userID, cookie := serveAuth(t, []AuthKey{retiredKey}, nil)
+
+	again, renewed := serveAuth(t, []AuthKey{currentKey, retiredKey}, cookie)
+	assert.Equal(t, userID, again)
+	require.NotNil(t, renewed)
+
+	again, _ = serveAuth(t, []AuthKey{currentKey}, renewed)
+	assert.Equal(t, userID, again)
+}
+
+func TestAuth_SlidingExpiry(t *testing.T) {
+	start := time.Now()
+	withNow(t, start)
+	userID, cookie := serveAuth(t, []AuthKey{currentKey}, nil)
+
+	withNow(t, start.Add(40*time.Minute))
+	again, renewed := serveAuth(t, []AuthKey{currentKey}, cookie)
+	assert.Equal(t, userID, again)
+	require.NotNil(t, renewed)
+
+	withNow(t, start.Add(90*time.Minute))
+	again, _ = serveAuth(t, []AuthKey{currentKey}, renewed)
+	assert.Equal(t, userID, again)
+
+	withNow(t, start.Add(3*time.Hour))
+	again, fresh := serveAuth(t, []AuthKey{currentKey}, renewed)
+	assert.NotEqual(t, userID, again)
+	assert.NotNil(t, fresh)
+}
+
+func TestAuth_ReplacesInvalidCookie(t *testing.T) {
+	for name, value := range map[string]string{
+		"short":    "00",
+		"garbage":  "not a cookie",
+		"empty":    "",
+		"tampered": "AQEy" + "AAAAAQAAAABjT0AA" + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, cookie := serveAuth(t, []AuthKey{currentKey}, &http.Cookie{Name: cookieName, Value: value})
+			assert.NotNil(t, cookie)
+		})
+	}
+}
+
+func TestAuth_LegacyCookies(t *testing.T) {
+	start := time.Now()
+	withNow(t, start)
+	legacyKey := AuthKey{Secret: []byte(":8080"), LegacyUntil: start.Add(time.Hour)}
+	id := []byte{0, 0, 0, 42, 1, 2, 3, 4}
+	value := hex.EncodeToString(append(id, sign(legacyKey.Secret, id)...))
+	legacy := &http.Cookie{Name: cookieName, Value: value}
+
+	userID, cookie := serveAuth(t, []AuthKey{currentKey, legacyKey}, legacy)
+	assert.Equal(t, uint32(42), userID)
+	require.NotNil(t, cookie)
+	claims, err := decodeAuthCookie(cookie.Value, []AuthKey{currentKey})
+	require.NoError(t, err)
+	assert.Equal(t, currentKey.ID, claims.keyID)
+
+	forged := createAuthCookie(7, legacyKey, time.Hour, false)
+	_, err = decodeAuthCookie(forged.Value, []AuthKey{currentKey, legacyKey})
+	assert.ErrorIs(t, err, errInvalidCookie)
+
+	userID, _ = serveAuth(t, []AuthKey{currentKey}, legacy)
+	assert.NotEqual(t, uint32(42), userID, "without a legacy key")
+	signed := hex.EncodeToString(append(id, sign(currentKey.Secret, id)...))
+	_, err = decodeAuthCookie(signed, []AuthKey{currentKey})
+	assert.ErrorIs(t, err, errInvalidCookie, "current keys do not verify the legacy format")
+
+	withNow(t, start.Add(2*time.Hour))
+	_, err = decodeAuthCookie(value, []AuthKey{currentKey, legacyKey})
+	assert.ErrorIs(t, err, errInvalidCookie, "after the deadline")
+}
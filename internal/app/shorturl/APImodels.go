@@ -1,23 +1,125 @@
 package shorturl
 
+import "time"
+
 type RequestURL struct {
-	URL string `json:"url"`
+	URL    string   `json:"url"`
+	Tags   []string `json:"tags,omitempty"`
+	Folder string   `json:"folder,omitempty"`
+}
+
+// RequestUpdateURL edits a link; omitted fields are left unchanged.
+type RequestUpdateURL struct {
+	URL     string    `json:"url,omitempty"`
+	Tags    *[]string `json:"tags,omitempty"`
+	Folder  *string   `json:"folder,omitempty"`
+	Preview *bool     `json:"preview,omitempty"`
 }
 type RespResultURL struct {
 	Result string `json:"result"`
 }
 
 type RespShortURL struct {
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Tags        []string  `json:"tags,omitempty"`
+	Folder      string    `json:"folder,omitempty"`
+	Clicks      int64     `json:"clicks"`
+	Preview     bool      `json:"preview,omitempty"`
+}
+
+type RespTag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type RequestRenameTag struct {
+	Name string `json:"name"`
+}
+
+type RequestMergeTags struct {
+	Tags []string `json:"tags"`
+	Into string   `json:"into"`
+}
+
+type RespTagUpdate struct {
+	Updated int `json:"updated"`
+}
+
+type RequestRollback struct {
+	Version int `json:"version"`
+}
+
+type RespRevision struct {
+	Version     int       `json:"version"`
+	OriginalURL string    `json:"original_url"`
+	EditorID    uint32    `json:"editor_id"`
+	EditedAt    time.Time `json:"edited_at"`
 }
 
 type RequestBatchURL struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string   `json:"correlation_id"`
+	OriginalURL   string   `json:"original_url"`
+	Tags          []string `json:"tags,omitempty"`
+	Folder        string   `json:"folder,omitempty"`
 }
 
+// ResponseBatchURL carries Status, and Reason for invalid urls, only in
+// partial mode.
 type ResponseBatchURL struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	ShortURL      string `json:"short_url,omitempty"`
+	Status        string `json:"status,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// RespImportJob is the progress of an import. Errors and Renamed, the rows
+// whose ID was taken, are limited to the first maxImportReported rows.
+type RespImportJob struct {
+	ID         string              `json:"id"`
+	Status     string              `json:"status"`
+	Total      int                 `json:"total"`
+	Processed  int                 `json:"processed"`
+	Created    int                 `json:"created"`
+	Existing   int                 `json:"existing"`
+	Failed     int                 `json:"failed"`
+	Errors     []RespImportError   `json:"errors,omitempty"`
+	Renamed    []RespImportRenamed `json:"renamed,omitempty"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt *time.Time          `json:"finished_at,omitempty"`
+}
+
+type RespImportError struct {
+	Line        int    `json:"line"`
+	OriginalURL string `json:"original_url,omitempty"`
+	Error       string `json:"error"`
+}
+
+type RespImportRenamed struct {
+	Line     int    `json:"line"`
+	ID       string `json:"id"`
+	ShortURL string `json:"short_url"`
+}
+
+// RespLinkInfo describes a link without following it. Tags, Folder and
+// Clicks are only shown to the owner.
+type RespLinkInfo struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Tags        []string  `json:"tags,omitempty"`
+	Folder      string    `json:"folder,omitempty"`
+	Clicks      *int64    `json:"clicks,omitempty"`
+}
+
+type RespExpandURL struct {
+	Input string `json:"input"`
+	*RespLinkInfo
+	Error string `json:"error,omitempty"`
+}
+
+type RespLookup struct {
+	OriginalURL string   `json:"original_url"`
+	ShortURLs   []string `json:"short_urls"`
 }
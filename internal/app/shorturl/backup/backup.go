@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"io"
+	"time"
+)
+
+const (
+	formatName    = "shortener-backup"
+	formatVersion = 2
+)
+
+type Policy string
+
+const (
+	PolicySkip      Policy = "skip"
+	PolicyOverwrite Policy = "overwrite"
+	PolicyFail      Policy = "fail"
+)
+
+var (
+	ErrInvalidArchive = errors.New("invalid backup archive")
+	ErrChecksum       = errors.New("backup archive checksum mismatch")
+	ErrCollision      = errors.New("short url id already exists")
+	ErrURLCollision   = errors.New("original url already shortened under another id")
+	ErrUnknownPolicy  = errors.New("unknown collision policy")
+)
+
+type Manifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Count     int       `json:"count,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+}
+
+type Link struct {
+	ID          string     `json:"id"`
+	OriginalURL string     `json:"original_url"`
+	UserID      uint32     `json:"user_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Tags        []string   `json:"tags,omitempty"`
+	Folder      string     `json:"folder,omitempty"`
+	Clicks      int64      `json:"clicks,omitempty"`
+	Preview     bool       `json:"preview,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	History     []Revision `json:"history,omitempty"`
+}
+
+type Revision struct {
+	Version     int       `json:"version"`
+	OriginalURL string    `json:"original_url"`
+	EditorID    uint32    `json:"editor_id"`
+	EditedAt    time.Time `json:"edited_at"`
+}
+
+type RestoreResult struct {
+	Restored    int `json:"restored"`
+	Skipped     int `json:"skipped"`
+	Overwritten int `json:"overwritten"`
+}
+
+// The archive is a gzip stream of NDJSON lines: a header, one line per link
+// and a trailing manifest with the link count and a SHA-256 of the link lines.
+type entry struct {
+	Header   *Manifest `json:"header,omitempty"`
+	Link     *Link     `json:"link,omitempty"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+func Write(ctx context.Context, st db.Storage, w io.Writer) (Manifest, error) {
+	gzw := gzip.NewWriter(w)
+	enc := json.NewEncoder(gzw)
+
+	manifest := Manifest{Format: formatName, Version: formatVersion, CreatedAt: time.Now().UTC()}
+	if err := enc.Encode(entry{Header: &manifest}); err != nil {
+		return Manifest{}, err
+	}
+
+	sum := sha256.New()
+	links := json.NewEncoder(io.MultiWriter(gzw, sum))
+	err := st.Iterate(ctx, func(url db.ShortURL) error {
+		revs, err := st.GetHistory(ctx, url.ID)
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		link := &Link{
+			ID:          url.ID,
+			OriginalURL: url.OriginURL,
+			UserID:      url.UserID,
+			CreatedAt:   url.CreatedAt.UTC(),
+			Tags:        url.Tags,
+			Folder:      url.Folder,
+			Clicks:      url.Clicks,
+			Preview:     url.Preview,
+			Title:       url.Title,
+		}
+		for _, rev := range revs {
+			link.History = append(link.History, Revision{
+				Version:     rev.Version,
+				OriginalURL: rev.OriginURL,
+				EditorID:    rev.EditorID,
+				EditedAt:    rev.EditedAt.UTC(),
+			})
+		}
+		manifest.Count++
+		return links.Encode(entry{Link: link})
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifest.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	if err := enc.Encode(entry{Manifest: &manifest}); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, gzw.Close()
+}
+
+func Verify(r io.Reader) (Manifest, error) {
+	return read(r, func(link Link) error { return nil })
+}
+
+// Restore applies policy both to links whose ID exists and to links whose URL
+// is already shortened under another ID.
+func Restore(ctx context.Context, st db.Storage, r io.Reader, policy Policy) (RestoreResult, error) {
+	var result RestoreResult
+	if policy != PolicySkip && policy != PolicyOverwrite && policy != PolicyFail {
+		return result, fmt.Errorf("%w: %s", ErrUnknownPolicy, policy)
+	}
+
+	_, err := read(r, func(link Link) error {
+		url := db.ShortURL{
+			ID:        link.ID,
+			OriginURL: link.OriginalURL,
+			UserID:    link.UserID,
+			CreatedAt: link.CreatedAt,
+			Tags:      link.Tags,
+			Folder:    link.Folder,
+			Clicks:    link.Clicks,
+			Preview:   link.Preview,
+			Title:     link.Title,
+		}
+		revs := make([]db.Revision, len(link.History))
+		for index, rev := range link.History {
+			revs[index] = db.Revision{Version: rev.Version, OriginURL: rev.OriginalURL, EditorID: rev.EditorID, EditedAt: rev.EditedAt}
+		}
+
+		_, err := st.GetByID(ctx, link.ID)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+		idTaken := err == nil
+		holder, err := st.GetByOriginalURL(ctx, link.OriginalURL)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+		if err != nil || holder == link.ID {
+			holder = ""
+		}
+
+		switch {
+		case !idTaken && holder == "":
+			result.Restored++
+			if err := st.Save(ctx, url); err != nil {
+				return err
+			}
+			return st.SetHistory(ctx, url.ID, revs)
+		case policy == PolicySkip:
+			result.Skipped++
+			return nil
+		case policy == PolicyFail && idTaken:
+			return fmt.Errorf("%w: %s", ErrCollision, link.ID)
+		case policy == PolicyFail:
+			return fmt.Errorf("%w: %s is %s", ErrURLCollision, link.OriginalURL, holder)
+		}
+		if err := overwrite(ctx, st, url, holder); err != nil {
+			return err
+		}
+		result.Overwritten++
+		return st.SetHistory(ctx, url.ID, revs)
+	})
+	return result, err
+}
+
+// overwrite saves url in place of the link with its ID and the link holding
+// its URL. Save replaces a link with the same ID by itself; the holder has to
+// be deleted first, so it is saved back if url cannot be.
+func overwrite(ctx context.Context, st db.Storage, url db.ShortURL, holder string) error {
+	if holder == "" {
+		return st.Save(ctx, url)
+	}
+	old, err := st.GetByID(ctx, holder)
+	if err != nil {
+		return err
+	}
+	if err := st.Delete(ctx, holder); err != nil {
+		return err
+	}
+	if err := st.Save(ctx, url); err != nil {
+		if errBack := st.Save(ctx, old); errBack != nil {
+			return fmt.Errorf("%w; restoring %s: %v", err, holder, errBack)
+		}
+		return err
+	}
+	return nil
+}
+
+func read(r io.Reader, fn func(link Link) error) (Manifest, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer gzr.Close()
+
+	reader := bufio.NewReader(gzr)
+	var header *Manifest
+	sum := sha256.New()
+	count := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return Manifest{}, fmt.Errorf("%w: missing manifest", ErrInvalidArchive)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Manifest{}, err
+		}
+
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return Manifest{}, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		switch {
+		case header == nil:
+			if e.Header == nil || e.Header.Format != formatName {
+				return Manifest{}, fmt.Errorf("%w: missing header", ErrInvalidArchive)
+			}
+			if e.Header.Version > formatVersion {
+				return Manifest{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, e.Header.Version)
+			}
+			header = e.Header
+		case e.Link != nil:
+			sum.Write(line)
+			count++
+			if err := fn(*e.Link); err != nil {
+				return Manifest{}, err
+			}
+		case e.Manifest != nil:
+			if e.Manifest.Count != count || e.Manifest.SHA256 != hex.EncodeToString(sum.Sum(nil)) {
+				return *e.Manifest, ErrChecksum
+			}
+			return *e.Manifest, nil
+		default:
+			return Manifest{}, fmt.Errorf("%w: unexpected entry", ErrInvalidArchive)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteRestore(t *testing.T) {
+	ctx := context.Background()
+	src := db.NewMemoryStorage()
+	id, err := src.Add(ctx, "https://example.com", 7)
+	require.NoError(t, err)
+	_, err = src.Add(ctx, "https://example.org", 8)
+	require.NoError(t, err)
+	_, err = src.SetLabels(ctx, id, []string{"promo"}, "Campaigns")
+	require.NoError(t, err)
+	require.NoError(t, src.AddClicks(ctx, map[string]int64{id: 3}))
+	_, err = src.SetTitle(ctx, id, "Example")
+	require.NoError(t, err)
+	_, err = src.UpdateURL(ctx, id, "https://example.com/new", 9)
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	manifest, err := Write(ctx, src, &archive)
+	require.NoError(t, err)
+	assert.Equal(t, 2, manifest.Count)
+
+	verified, err := Verify(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, manifest.SHA256, verified.SHA256)
+
+	dst := db.NewMemoryStorage()
+	result, err := Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicyFail)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Restored: 2}, result)
+
+	url, err := dst.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), url.UserID)
+	assert.Equal(t, []string{"promo"}, url.Tags)
+	assert.Equal(t, "Campaigns", url.Folder)
+	assert.Equal(t, int64(3), url.Clicks)
+	assert.Equal(t, "Example", url.Title)
+	assert.Equal(t, "https://example.com/new", url.OriginURL)
+	revs, err := dst.GetHistory(ctx, id)
+	require.NoError(t, err)
+	require.Len(t, revs, 1)
+	assert.Equal(t, "https://example.com", revs[0].OriginURL)
+	assert.Equal(t, uint32(9), revs[0].EditorID)
+
+	result, err = Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicySkip)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Skipped: 2}, result)
+
+	result, err = Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicyOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Overwritten: 2}, result)
+	revs, err = dst.GetHistory(ctx, id)
+	require.NoError(t, err)
+	assert.Len(t, revs, 1)
+
+	_, err = Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicyFail)
+	assert.ErrorIs(t, err, ErrCollision)
+}
+
+func TestRestore_URLCollision(t *testing.T) {
+	ctx := context.Background()
+	src := db.NewMemoryStorage()
+	require.NoError(t, src.Save(ctx, db.ShortURL{ID: "archived", OriginURL: "https://example.com", UserID: 7}))
+
+	var archive bytes.Buffer
+	_, err := Write(ctx, src, &archive)
+	require.NoError(t, err)
+
+	dst := db.NewMemoryStorage()
+	require.NoError(t, dst.Save(ctx, db.ShortURL{ID: "current", OriginURL: "https://example.com", UserID: 8}))
+
+	_, err = Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicyFail)
+	assert.ErrorIs(t, err, ErrURLCollision)
+
+	result, err := Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicySkip)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Skipped: 1}, result)
+
+	result, err = Restore(ctx, dst, bytes.NewReader(archive.Bytes()), PolicyOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Overwritten: 1}, result)
+	id, err := dst.GetByOriginalURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "archived", id)
+	_, err = dst.GetByID(ctx, "current")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+}
+
+func TestVerify_Tampered(t *testing.T) {
+	ctx := context.Background()
+	src := db.NewMemoryStorage()
+	_, err := src.Add(ctx, "https://example.com", 7)
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	_, err = Write(ctx, src, &archive)
+	require.NoError(t, err)
+
+	gzr, err := gzip.NewReader(&archive)
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gzr)
+	require.NoError(t, err)
+
+	var tampered bytes.Buffer
+	gzw := gzip.NewWriter(&tampered)
+	_, err = gzw.Write([]byte(strings.Replace(string(plain), "example.com", "evil.example", 1)))
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+
+	_, err = Verify(&tampered)
+	assert.ErrorIs(t, err, ErrChecksum)
+}
@@ -0,0 +1,483 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"time"
+)
+
+const boltPageSize = 1000
+
+var (
+	linksBucket    = []byte("links")
+	originalBucket = []byte("original")
+	usersBucket    = []byte("users")
+	historyBucket  = []byte("history")
+)
+
+type dbBolt struct {
+	db    *bolt.DB
+	idGen IDGenerator
+}
+
+func NewBoltStorage(path string) (*dbBolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{linksBucket, originalBucket, usersBucket, historyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &dbBolt{db: db, idGen: defaultIDGenerator()}, nil
+}
+
+func (b *dbBolt) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	var id string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		id, err = b.insert(tx, ShortURL{OriginURL: url, UserID: userID})
+		return err
+	})
+	return id, err
+}
+
+func (b *dbBolt) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for index, url := range urls {
+			id, err := b.insert(tx, ShortURL{OriginURL: url.OriginURL, UserID: userID, Tags: url.Tags, Folder: url.Folder})
+			if err != nil {
+				return err
+			}
+			urls[index].ID = id
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (b *dbBolt) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	var url ShortURL
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		url, err = getLink(tx, id)
+		return err
+	})
+	return url, err
+}
+
+func (b *dbBolt) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	var id string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := originalKey(url, "")
+		k, _ := tx.Bucket(originalBucket).Cursor().Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return ErrNotFound
+		}
+		id = string(k[len(prefix):])
+		return nil
+	})
+	return id, err
+}
+
+func (b *dbBolt) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	var urls []ShortURL
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		urls, err = userLinks(tx, userID)
+		return err
+	})
+	return urls, err
+}
+
+func (b *dbBolt) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	urls, err := b.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return iterateOldestFirst(ctx, urls, fn)
+}
+
+func (b *dbBolt) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	urls, err := b.GetURLsByUserID(ctx, q.UserID)
+	if err != nil {
+		return URLPage{}, err
+	}
+	return filterURLs(urls, q)
+}
+
+func (b *dbBolt) Save(ctx context.Context, url ShortURL) error {
+	url.CorrelationID = ""
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteLink(tx, url.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return putLink(tx, url)
+	})
+}
+
+func (b *dbBolt) Delete(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteLink(tx, id); err != nil {
+			return err
+		}
+		return deleteHistory(tx, id)
+	})
+}
+
+func (b *dbBolt) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	var sURL ShortURL
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if sURL, err = getLink(tx, id); err != nil {
+			return err
+		}
+		revs, err := getHistory(tx, id)
+		if err != nil {
+			return err
+		}
+		rev := Revision{Version: len(revs) + 1, OriginURL: sURL.OriginURL, EditorID: editorID, EditedAt: time.Now()}
+		data, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(historyBucket).Put(historyKey(id, rev.Version), data); err != nil {
+			return err
+		}
+		if err := deleteLink(tx, id); err != nil {
+			return err
+		}
+		sURL.OriginURL = url
+		return putLink(tx, sURL)
+	})
+	return sURL, err
+}
+
+func (b *dbBolt) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	var revs []Revision
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if _, err := getLink(tx, id); err != nil {
+			return err
+		}
+		var err error
+		revs, err = getHistory(tx, id)
+		return err
+	})
+	return revs, err
+}
+
+func (b *dbBolt) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getLink(tx, id); err != nil {
+			return err
+		}
+		if err := deleteHistory(tx, id); err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			data, err := json.Marshal(rev)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(historyBucket).Put(historyKey(id, rev.Version), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *dbBolt) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	var sURL ShortURL
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if sURL, err = getLink(tx, id); err != nil {
+			return err
+		}
+		sURL.Preview = preview
+		return putLink(tx, sURL)
+	})
+	return sURL, err
+}
+
+func (b *dbBolt) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	var sURL ShortURL
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if sURL, err = getLink(tx, id); err != nil {
+			return err
+		}
+		sURL.Title = title
+		return putLink(tx, sURL)
+	})
+	return sURL, err
+}
+
+func (b *dbBolt) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	var sURL ShortURL
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if sURL, err = getLink(tx, id); err != nil {
+			return err
+		}
+		sURL.Tags, sURL.Folder = tags, folder
+		return putLink(tx, sURL)
+	})
+	return sURL, err
+}
+
+func (b *dbBolt) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	urls, err := b.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return countTags(urls), nil
+}
+
+func (b *dbBolt) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	var changed []ShortURL
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		urls, err := userLinks(tx, userID)
+		if err != nil {
+			return err
+		}
+		changed = retagAll(urls, from, to)
+		for _, url := range changed {
+			if err := putLink(tx, url); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return linkIDs(changed), nil
+}
+
+func (b *dbBolt) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for id, n := range clicks {
+			url, err := getLink(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			url.Clicks += n
+			data, err := json.Marshal(url)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(linksBucket).Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate reads links in pages so fn runs outside of a read transaction and
+// may write to the same storage.
+func (b *dbBolt) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	var after []byte
+	for {
+		page := make([]ShortURL, 0, boltPageSize)
+		err := b.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(linksBucket).Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(page) < boltPageSize; k, v = c.Next() {
+				var url ShortURL
+				if err := json.Unmarshal(v, &url); err != nil {
+					return err
+				}
+				page = append(page, url)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, url := range page {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+		if len(page) < boltPageSize {
+			return nil
+		}
+		after = []byte(page[len(page)-1].ID)
+	}
+}
+
+// Backup writes a consistent copy of the database file to w.
+func (b *dbBolt) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func (b *dbBolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *dbBolt) SetIDGenerator(gen IDGenerator) {
+	b.idGen = gen
+}
+
+func (b *dbBolt) Insert(ctx context.Context, url ShortURL) error {
+	url.CorrelationID = ""
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(linksBucket).Get([]byte(url.ID)) != nil {
+			return ErrIDTaken
+		}
+		prefix := originalKey(url.OriginURL, "")
+		if k, _ := tx.Bucket(originalBucket).Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+			return ErrConflict
+		}
+		return putLink(tx, url)
+	})
+}
+
+func (b *dbBolt) insert(tx *bolt.Tx, url ShortURL) (string, error) {
+	links := tx.Bucket(linksBucket)
+	id, err := newID(b.idGen, url.OriginURL, func(id string) (bool, error) {
+		return links.Get([]byte(id)) == nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	url.ID, url.CreatedAt = id, time.Now()
+	return id, putLink(tx, url)
+}
+
+func getLink(tx *bolt.Tx, id string) (ShortURL, error) {
+	var url ShortURL
+	data := tx.Bucket(linksBucket).Get([]byte(id))
+	if data == nil {
+		return url, ErrNotFound
+	}
+	err := json.Unmarshal(data, &url)
+	return url, err
+}
+
+func userLinks(tx *bolt.Tx, userID uint32) ([]ShortURL, error) {
+	var urls []ShortURL
+	prefix := userKey(userID, "")
+	c := tx.Bucket(usersBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		url, err := getLink(tx, string(k[len(prefix):]))
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func putLink(tx *bolt.Tx, url ShortURL) error {
+	data, err := json.Marshal(url)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(linksBucket).Put([]byte(url.ID), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(originalBucket).Put(originalKey(url.OriginURL, url.ID), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(usersBucket).Put(userKey(url.UserID, url.ID), nil)
+}
+
+func deleteLink(tx *bolt.Tx, id string) error {
+	url, err := getLink(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(linksBucket).Delete([]byte(id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(originalBucket).Delete(originalKey(url.OriginURL, id)); err != nil {
+		return err
+	}
+	return tx.Bucket(usersBucket).Delete(userKey(url.UserID, id))
+}
+
+func getHistory(tx *bolt.Tx, id string) ([]Revision, error) {
+	revs := []Revision{}
+	prefix := historyKey(id, 0)[:len(id)+1]
+	c := tx.Bucket(historyBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var rev Revision
+		if err := json.Unmarshal(v, &rev); err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+func deleteHistory(tx *bolt.Tx, id string) error {
+	prefix := historyKey(id, 0)[:len(id)+1]
+	c := tx.Bucket(historyBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func historyKey(id string, version int) []byte {
+	key := make([]byte, len(id)+5)
+	copy(key, id)
+	binary.BigEndian.PutUint32(key[len(id)+1:], uint32(version))
+	return key
+}
+
+func originalKey(url, id string) []byte {
+	return []byte(lookupKey(url) + "\x00" + id)
+}
+
+func userKey(userID uint32, id string) []byte {
+	key := make([]byte, 4, 4+len(id))
+	binary.BigEndian.PutUint32(key, userID)
+	return append(key, id...)
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStorage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st, err := NewBoltStorage(filepath.Join(dir, "urls.db"))
+	require.NoError(t, err)
+	defer st.Close()
+
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	batch, err := st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org"}, {OriginURL: "https://example.net"}}, 2)
+	require.NoError(t, err)
+	require.Len(t, batch, 2)
+
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", url.OriginURL)
+
+	found, err := st.GetByOriginalURL(ctx, "https://example.net")
+	require.NoError(t, err)
+	assert.Equal(t, batch[1].ID, found)
+
+	urls, err := st.GetURLsByUserID(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+
+	require.NoError(t, st.Save(ctx, ShortURL{ID: id, OriginURL: "https://example.io", UserID: 2}))
+	_, err = st.GetByOriginalURL(ctx, "https://example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+	urls, err = st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, urls)
+
+	require.NoError(t, st.Delete(ctx, batch[0].ID))
+	count := 0
+	require.NoError(t, st.Iterate(ctx, func(url ShortURL) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 2, count)
+
+	var buf bytes.Buffer
+	n, err := st.Backup(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	snapshot := filepath.Join(dir, "snapshot.db")
+	require.NoError(t, os.WriteFile(snapshot, buf.Bytes(), 0600))
+	copied, err := NewBoltStorage(snapshot)
+	require.NoError(t, err)
+	defer copied.Close()
+	_, err = copied.GetByID(ctx, id)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type CacheStats struct {
+	Hits         uint64  `json:"hits"`
+	NegativeHits uint64  `json:"negative_hits"`
+	Misses       uint64  `json:"misses"`
+	Evictions    uint64  `json:"evictions"`
+	Size         int     `json:"size"`
+	HitRate      float64 `json:"hit_rate"`
+}
+
+type cacheEntry struct {
+	id      string
+	url     ShortURL
+	found   bool
+	expires time.Time
+}
+
+// cacheLoad tracks the misses of one ID still loading from the storage.
+// Invalidating the ID bumps version, so their results are not cached.
+type cacheLoad struct {
+	loaders int
+	version uint64
+}
+
+// CachedStorage serves GetByID from a bounded LRU. Unknown IDs are cached
+// too, for negativeTTL, so repeated misses do not reach the storage.
+type CachedStorage struct {
+	Storage
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	loads map[string]*cacheLoad
+	stats CacheStats
+}
+
+func NewCachedStorage(st Storage, size int, ttl, negativeTTL time.Duration) *CachedStorage {
+	return &CachedStorage{
+		Storage:     st,
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+		loads:       make(map[string]*cacheLoad),
+	}
+}
+
+func (c *CachedStorage) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	entry, version, ok := c.get(id)
+	if ok {
+		if !entry.found {
+			return ShortURL{}, ErrNotFound
+		}
+		return entry.url, nil
+	}
+
+	url, err := c.Storage.GetByID(ctx, id)
+	switch {
+	case err == nil:
+		c.put(id, &cacheEntry{id: id, url: url, found: true, expires: time.Now().Add(c.ttl)}, version)
+	case errors.Is(err, ErrNotFound) && c.negativeTTL > 0:
+		c.put(id, &cacheEntry{id: id, expires: time.Now().Add(c.negativeTTL)}, version)
+	default:
+		c.put(id, nil, version)
+	}
+	return url, err
+}
+
+func (c *CachedStorage) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	id, err := c.Storage.Add(ctx, url, userID)
+	if err == nil {
+		c.Invalidate(id)
+	}
+	return id, err
+}
+
+func (c *CachedStorage) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	urls, err := c.Storage.AddBatchURL(ctx, urls, userID)
+	for _, url := range urls {
+		c.Invalidate(url.ID)
+	}
+	return urls, err
+}
+
+func (c *CachedStorage) Save(ctx context.Context, url ShortURL) error {
+	defer c.Invalidate(url.ID)
+	return c.Storage.Save(ctx, url)
+}
+
+func (c *CachedStorage) Insert(ctx context.Context, url ShortURL) error {
+	defer c.Invalidate(url.ID)
+	return c.Storage.Insert(ctx, url)
+}
+
+func (c *CachedStorage) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	defer c.Invalidate(id)
+	return c.Storage.UpdateURL(ctx, id, url, editorID)
+}
+
+func (c *CachedStorage) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	defer c.Invalidate(id)
+	return c.Storage.SetPreview(ctx, id, preview)
+}
+
+func (c *CachedStorage) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	defer c.Invalidate(id)
+	return c.Storage.SetTitle(ctx, id, title)
+}
+
+func (c *CachedStorage) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	defer c.Invalidate(id)
+	return c.Storage.SetLabels(ctx, id, tags, folder)
+}
+
+func (c *CachedStorage) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	ids, err := c.Storage.RenameTag(ctx, userID, from, to)
+	for _, id := range ids {
+		c.Invalidate(id)
+	}
+	return ids, err
+}
+
+func (c *CachedStorage) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	defer func() {
+		for id := range clicks {
+			c.Invalidate(id)
+		}
+	}()
+	return c.Storage.AddClicks(ctx, clicks)
+}
+
+func (c *CachedStorage) Delete(ctx context.Context, id string) error {
+	defer c.Invalidate(id)
+	return c.Storage.Delete(ctx, id)
+}
+
+func (c *CachedStorage) Invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if load, ok := c.loads[id]; ok {
+		load.version++
+	}
+	if el, ok := c.items[id]; ok {
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+func (c *CachedStorage) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, load := range c.loads {
+		load.version++
+	}
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *CachedStorage) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.ll.Len()
+	if total := stats.Hits + stats.NegativeHits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits+stats.NegativeHits) / float64(total)
+	}
+	return stats
+}
+
+func (c *CachedStorage) Unwrap() Storage {
+	return c.Storage
+}
+
+func (c *CachedStorage) Close() error {
+	if closer, ok := c.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// get returns the cached entry. On a miss it registers a load of id and
+// returns its version, which put needs to finish the load.
+func (c *CachedStorage) get(id string) (cacheEntry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		entry := el.Value.(cacheEntry)
+		if !time.Now().After(entry.expires) {
+			c.ll.MoveToFront(el)
+			if entry.found {
+				c.stats.Hits++
+			} else {
+				c.stats.NegativeHits++
+			}
+			return entry, 0, true
+		}
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+	c.stats.Misses++
+	load, ok := c.loads[id]
+	if !ok {
+		load = &cacheLoad{}
+		c.loads[id] = load
+	}
+	load.loaders++
+	return cacheEntry{}, load.version, false
+}
+
+// put finishes a load started by get and caches entry unless it is nil or
+// id was invalidated since the load began.
+func (c *CachedStorage) put(id string, entry *cacheEntry, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	load := c.loads[id]
+	if load.loaders--; load.loaders == 0 {
+		delete(c.loads, id)
+	}
+	if entry == nil || load.version != version {
+		return
+	}
+	if el, ok := c.items[id]; ok {
+		el.Value = *entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[id] = c.ll.PushFront(*entry)
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(cacheEntry).id)
+		c.stats.Evictions++
+	}
+}
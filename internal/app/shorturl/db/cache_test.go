@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCachedStorage(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStorage()
+	st := NewCachedStorage(backend, 2, time.Minute, time.Minute)
+
+	_, err := st.GetByID(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, backend.Save(ctx, ShortURL{ID: "unknown", OriginURL: "https://example.com"}))
+	_, err = st.GetByID(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound, "negative entry should be served from cache")
+
+	require.NoError(t, st.Save(ctx, ShortURL{ID: "unknown", OriginURL: "https://example.org"}))
+	url, err := st.GetByID(ctx, "unknown")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.org", url.OriginURL)
+
+	first, err := st.Add(ctx, "https://example.net", 1)
+	require.NoError(t, err)
+	second, err := st.Add(ctx, "https://example.io", 1)
+	require.NoError(t, err)
+	for _, id := range []string{first, second, first} {
+		_, err := st.GetByID(ctx, id)
+		require.NoError(t, err)
+	}
+
+	stats := st.Stats()
+	assert.Equal(t, 2, stats.Size)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.NegativeHits)
+
+	require.NoError(t, st.Delete(ctx, first))
+	_, err = st.GetByID(ctx, first)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCachedStorage_Expiry(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStorage()
+	st := NewCachedStorage(backend, 10, time.Millisecond, 0)
+
+	id, err := backend.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	_, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+
+	require.NoError(t, backend.Delete(ctx, id))
+	time.Sleep(5 * time.Millisecond)
+	_, err = st.GetByID(ctx, id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, 0, st.Stats().Size, "not found results are not cached without a negative TTL")
+}
+
+// hookedGet runs hook after each read of the storage, before the cache
+// sees the result.
+type hookedGet struct {
+	Storage
+	hook func(id string)
+}
+
+func (h hookedGet) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	url, err := h.Storage.GetByID(ctx, id)
+	h.hook(id)
+	return url, err
+}
+
+func TestCachedStorage_InvalidateDuringLoad(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryStorage()
+	id, err := backend.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+
+	var st *CachedStorage
+	invalidate := "other"
+	st = NewCachedStorage(hookedGet{Storage: backend, hook: func(string) { st.Invalidate(invalidate) }}, 10, time.Minute, time.Minute)
+
+	_, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.Stats().Size, "invalidating another id keeps the load")
+
+	st.Invalidate(id)
+	invalidate = id
+	_, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 0, st.Stats().Size, "a load raced by its own invalidation is dropped")
+	assert.Empty(t, st.loads)
+}
+
+func TestCachedStorage_AddClicksInvalidates(t *testing.T) {
+	ctx := context.Background()
+	st := NewCachedStorage(NewMemoryStorage(), 10, time.Minute, time.Minute)
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	_, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+
+	require.NoError(t, st.AddClicks(ctx, map[string]int64{id: 2}))
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), url.Clicks)
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// ClickBuffer counts redirects in memory and adds them to the storage every
+// interval, so a popular link costs one write per interval instead of one
+// per click. Clicks not flushed yet are lost if the process crashes. With an
+// interval of zero or less every click is written through instead.
+type ClickBuffer struct {
+	st       Storage
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewClickBuffer(st Storage, interval time.Duration) *ClickBuffer {
+	b := &ClickBuffer{
+		st:       st,
+		interval: interval,
+		pending:  make(map[string]int64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if interval > 0 {
+		go b.run(interval)
+	} else {
+		close(b.done)
+	}
+	return b
+}
+
+func (b *ClickBuffer) Record(id string) {
+	if b.interval <= 0 {
+		if err := b.st.AddClicks(context.Background(), map[string]int64{id: 1}); err != nil {
+			log.Printf("click write: %v", err)
+		}
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[id]++
+}
+
+// Flush adds the clicks counted so far to the storage. On failure they are
+// kept for the next flush.
+func (b *ClickBuffer) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	clicks := b.pending
+	b.pending = make(map[string]int64)
+	b.mu.Unlock()
+
+	if len(clicks) == 0 {
+		return nil
+	}
+	err := b.st.AddClicks(ctx, clicks)
+	if err != nil {
+		b.mu.Lock()
+		for id, n := range clicks {
+			b.pending[id] += n
+		}
+		b.mu.Unlock()
+	}
+	return err
+}
+
+// Close stops the background flushes and flushes what is left.
+func (b *ClickBuffer) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush(context.Background())
+}
+
+func (b *ClickBuffer) run(interval time.Duration) {
+	defer close(b.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(context.Background()); err != nil {
+				log.Printf("click flush: %v", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_AddClicks(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := NewBoltStorage(filepath.Join(dir, "urls.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	_, client := newTestRedis(t)
+
+	storages := map[string]Storage{
+		"memory":    NewMemoryStorage(),
+		"file":      file,
+		"bolt":      bolt,
+		"sqlite":    newTestSQLite(t),
+		"redis":     NewRedisStorage(client),
+		"sharded":   NewShardedStorage(Shard{Name: "a", Storage: NewMemoryStorage()}, Shard{Name: "b", Storage: newTestSQLite(t)}),
+		"migrating": NewMigratingStorage(NewMemoryStorage(), NewMemoryStorage()),
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			first, err := st.Add(ctx, "https://example.com/"+name+"/1", 1)
+			require.NoError(t, err)
+			second, err := st.Add(ctx, "https://example.com/"+name+"/2", 1)
+			require.NoError(t, err)
+
+			require.NoError(t, st.AddClicks(ctx, map[string]int64{first: 3, second: 1, "missing": 5}))
+			require.NoError(t, st.AddClicks(ctx, map[string]int64{first: 2}))
+
+			url, err := st.GetByID(ctx, first)
+			require.NoError(t, err)
+			assert.Equal(t, int64(5), url.Clicks)
+			page, err := st.ListURLs(ctx, URLQuery{UserID: 1, Sort: SortURLAsc})
+			require.NoError(t, err)
+			require.Len(t, page.URLs, 2)
+			assert.Equal(t, int64(1), page.URLs[1].Clicks)
+			_, err = st.GetByID(ctx, "missing")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			_, err = st.UpdateURL(ctx, first, "https://example.com/"+name+"/3", 1)
+			require.NoError(t, err)
+			url, err = st.GetByID(ctx, first)
+			require.NoError(t, err)
+			assert.Equal(t, int64(5), url.Clicks)
+		})
+	}
+}
+
+func TestClickBuffer(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+
+	buffer := NewClickBuffer(st, time.Hour)
+	buffer.Record(id)
+	buffer.Record(id)
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Zero(t, url.Clicks)
+
+	require.NoError(t, buffer.Flush(ctx))
+	buffer.Record(id)
+	require.NoError(t, buffer.Close())
+	url, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), url.Clicks)
+}
+
+func TestClickBuffer_WritesThroughWithoutInterval(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+
+	buffer := NewClickBuffer(st, 0)
+	buffer.Record(id)
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), url.Clicks)
+	require.NoError(t, buffer.Close())
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/jackc/pgerrcode"
+	"github.com/lib/pq"
+	"io"
+	sqlitelib "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strings"
+	"time"
+)
+
+// dialect covers the few places where Postgres and SQLite differ. Queries use
+// $N placeholders, which both drivers accept.
+type dialect interface {
+	name() string
+	migrationDriver(db *sql.DB) (database.Driver, error)
+	rewriteMigration(query string) string
+	isURLConflict(err error) bool
+	supportsNotify() bool
+	skipLocked() string
+	forUpdate() string
+	caseInsensitiveLike() string
+	timestamp(column string) string
+	timeValue(t time.Time) interface{}
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string {
+	return "postgres"
+}
+
+func (postgresDialect) migrationDriver(db *sql.DB) (database.Driver, error) {
+	return postgres.WithInstance(db, &postgres.Config{})
+}
+
+func (postgresDialect) rewriteMigration(query string) string {
+	return query
+}
+
+func (postgresDialect) isURLConflict(err error) bool {
+	var pe *pq.Error
+	return errors.As(err, &pe) && pe.Code == pgerrcode.UniqueViolation &&
+		(pe.Constraint == "originurl_idx" || pe.Constraint == "url_index_idx")
+}
+
+func (postgresDialect) supportsNotify() bool {
+	return true
+}
+
+func (postgresDialect) skipLocked() string {
+	return " FOR UPDATE SKIP LOCKED"
+}
+
+func (postgresDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (postgresDialect) caseInsensitiveLike() string {
+	return "ILIKE"
+}
+
+func (postgresDialect) timestamp(column string) string {
+	return column
+}
+
+func (postgresDialect) timeValue(t time.Time) interface{} {
+	return t
+}
+
+const sqliteTimeFormat = "2006-01-02 15:04:05.000"
+
+type sqliteDialect struct{}
+
+// SQLite has no ALTER COLUMN and does not enforce varchar lengths, so
+// widening a column is a no-op there.
+var sqliteTypes = strings.NewReplacer(
+	"bigserial", "integer",
+	"ALTER TABLE urls ALTER COLUMN originUrl TYPE varchar(4096)", "SELECT 1",
+	"ALTER TABLE urls ALTER COLUMN originUrl TYPE varchar(2100)", "SELECT 1",
+)
+
+func (sqliteDialect) name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) migrationDriver(db *sql.DB) (database.Driver, error) {
+	return sqlite.WithInstance(db, &sqlite.Config{})
+}
+
+func (sqliteDialect) rewriteMigration(query string) string {
+	return sqliteTypes.Replace(query)
+}
+
+func (sqliteDialect) isURLConflict(err error) bool {
+	return isSQLiteUnique(err, "urls.originurl") || isSQLiteUnique(err, "urls.url_index")
+}
+
+func (sqliteDialect) supportsNotify() bool {
+	return false
+}
+
+// skipLocked is empty as SQLite serializes writers anyway.
+func (sqliteDialect) skipLocked() string {
+	return ""
+}
+
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+func (sqliteDialect) caseInsensitiveLike() string {
+	return "LIKE"
+}
+
+// SQLite keeps times as text, so they are bound in UTC in its own format to
+// compare correctly; the column default omits milliseconds, hence strftime.
+func (sqliteDialect) timestamp(column string) string {
+	return "strftime('%Y-%m-%d %H:%M:%f', " + column + ")"
+}
+
+func (sqliteDialect) timeValue(t time.Time) interface{} {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func isSQLiteUnique(err error, column string) bool {
+	var se *sqlitelib.Error
+	return errors.As(err, &se) && se.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE &&
+		strings.Contains(strings.ToLower(se.Error()), column)
+}
+
+// rewritingSource lets a dialect adjust the shared migrations before they run.
+type rewritingSource struct {
+	source.Driver
+	rewrite func(query string) string
+}
+
+func (s *rewritingSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	r, identifier, err := s.Driver.ReadUp(version)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.rewriteBody(r, identifier)
+}
+
+func (s *rewritingSource) ReadDown(version uint) (io.ReadCloser, string, error) {
+	r, identifier, err := s.Driver.ReadDown(version)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.rewriteBody(r, identifier)
+}
+
+func (s *rewritingSource) rewriteBody(r io.ReadCloser, identifier string) (io.ReadCloser, string, error) {
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return io.NopCloser(strings.NewReader(s.rewrite(string(body)))), identifier, nil
+}
@@ -0,0 +1,452 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	sealedPrefix = "enc:v2:"
+	dataKeySize  = 32
+)
+
+var (
+	ErrNoEncryptionKey      = errors.New("at least one encryption key is required")
+	ErrInvalidEncryptionKey = errors.New("encryption key must have an id without ':' and at least 16 bytes of secret")
+	ErrUnknownEncryptionKey = errors.New("url encrypted with an unknown key")
+	ErrMalformedCiphertext  = errors.New("malformed encrypted url")
+)
+
+type EncryptionKey struct {
+	ID     string
+	Secret []byte
+}
+
+type urlKey struct {
+	id    string
+	wrap  cipher.AEAD
+	index []byte
+}
+
+// EncryptedStorage stores OriginURL as
+// "enc:v2:<blind index>:<key id>:<wrapped data key>:<sealed url>". Every URL
+// is sealed under a random nonce with a data key of its own, which is wrapped
+// with the configured key. The blind index is a keyed HMAC of the URL;
+// storages index it instead of the ciphertext, so GetByOriginalURL and unique
+// URLs keep working. Values without the prefix are read as plaintext, so
+// encryption can be turned on for existing data.
+type EncryptedStorage struct {
+	Storage
+	keys []urlKey
+}
+
+// NewEncryptedStorage seals new URLs with the first key; the others are
+// only used to read URLs sealed before a rotation.
+func NewEncryptedStorage(st Storage, keys ...EncryptionKey) (*EncryptedStorage, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+	e := &EncryptedStorage{Storage: st}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") || len(key.Secret) < 16 {
+			return nil, ErrInvalidEncryptionKey
+		}
+		wrap, err := newAEAD(deriveKey(key.Secret, "key wrapping"))
+		if err != nil {
+			return nil, err
+		}
+		e.keys = append(e.keys, urlKey{id: key.ID, wrap: wrap, index: deriveKey(key.Secret, "index")})
+	}
+	return e, nil
+}
+
+func (e *EncryptedStorage) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	if err := e.checkFree(ctx, url); err != nil {
+		return "", err
+	}
+	sealed, err := e.seal(e.keys[0], url)
+	if err != nil {
+		return "", err
+	}
+	return e.Storage.Add(ctx, sealed, userID)
+}
+
+func (e *EncryptedStorage) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	seen := make(map[string]bool, len(urls))
+	sealed := make([]ShortURL, len(urls))
+	for index, url := range urls {
+		if seen[url.OriginURL] {
+			return nil, ErrConflict
+		}
+		seen[url.OriginURL] = true
+		if err := e.checkFree(ctx, url.OriginURL); err != nil {
+			return nil, err
+		}
+		sealed[index] = url
+		var err error
+		if sealed[index].OriginURL, err = e.seal(e.keys[0], url.OriginURL); err != nil {
+			return nil, err
+		}
+	}
+	sealed, err := e.Storage.AddBatchURL(ctx, sealed, userID)
+	if err != nil {
+		return nil, err
+	}
+	for index := range sealed {
+		urls[index].ID = sealed[index].ID
+	}
+	return urls, nil
+}
+
+func (e *EncryptedStorage) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	url, err := e.Storage.GetByID(ctx, id)
+	if err != nil {
+		return url, err
+	}
+	return e.openURL(url)
+}
+
+// GetByOriginalURL tries the blind index under every key, then plaintext URLs.
+func (e *EncryptedStorage) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	candidates := make([]string, 0, len(e.keys)+1)
+	for _, key := range e.keys {
+		candidates = append(candidates, key.blindIndex(url))
+	}
+	for _, candidate := range append(candidates, url) {
+		id, err := e.Storage.GetByOriginalURL(ctx, candidate)
+		if !errors.Is(err, ErrNotFound) {
+			return id, err
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (e *EncryptedStorage) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	urls, err := e.Storage.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for index := range urls {
+		if urls[index], err = e.openURL(urls[index]); err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+func (e *EncryptedStorage) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	return e.Storage.IterateUser(ctx, userID, func(url ShortURL) error {
+		url, err := e.openURL(url)
+		if err != nil {
+			return err
+		}
+		return fn(url)
+	})
+}
+
+// ListURLs filters in memory, as the storage only sees ciphertexts.
+func (e *EncryptedStorage) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	urls, err := e.GetURLsByUserID(ctx, q.UserID)
+	if err != nil {
+		return URLPage{}, err
+	}
+	return filterURLs(urls, q)
+}
+
+func (e *EncryptedStorage) Save(ctx context.Context, url ShortURL) error {
+	url, err := e.sealURL(url)
+	if err != nil {
+		return err
+	}
+	return e.Storage.Save(ctx, url)
+}
+
+func (e *EncryptedStorage) Insert(ctx context.Context, url ShortURL) error {
+	if err := e.checkFree(ctx, url.OriginURL); err != nil {
+		return err
+	}
+	url, err := e.sealURL(url)
+	if err != nil {
+		return err
+	}
+	return e.Storage.Insert(ctx, url)
+}
+
+func (e *EncryptedStorage) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	sealed, err := e.seal(e.keys[0], url)
+	if err != nil {
+		return ShortURL{}, err
+	}
+	sURL, err := e.Storage.UpdateURL(ctx, id, sealed, editorID)
+	if err != nil {
+		return sURL, err
+	}
+	sURL.OriginURL = url
+	return sURL, nil
+}
+
+func (e *EncryptedStorage) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	sURL, err := e.Storage.SetPreview(ctx, id, preview)
+	if err != nil {
+		return sURL, err
+	}
+	return e.openURL(sURL)
+}
+
+// SetTitle seals the title too, as it tells as much about the destination.
+func (e *EncryptedStorage) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	if title != "" {
+		var err error
+		if title, err = e.seal(e.keys[0], title); err != nil {
+			return ShortURL{}, err
+		}
+	}
+	sURL, err := e.Storage.SetTitle(ctx, id, title)
+	if err != nil {
+		return sURL, err
+	}
+	return e.openURL(sURL)
+}
+
+func (e *EncryptedStorage) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	sURL, err := e.Storage.SetLabels(ctx, id, tags, folder)
+	if err != nil {
+		return sURL, err
+	}
+	return e.openURL(sURL)
+}
+
+func (e *EncryptedStorage) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	revs, err := e.Storage.GetHistory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for index := range revs {
+		if revs[index].OriginURL, err = e.open(revs[index].OriginURL); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
+
+func (e *EncryptedStorage) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	sealed := make([]Revision, len(revs))
+	for index, rev := range revs {
+		var err error
+		if rev.OriginURL, err = e.seal(e.keys[0], rev.OriginURL); err != nil {
+			return err
+		}
+		sealed[index] = rev
+	}
+	return e.Storage.SetHistory(ctx, id, sealed)
+}
+
+func (e *EncryptedStorage) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	return e.Storage.Iterate(ctx, func(url ShortURL) error {
+		url, err := e.openURL(url)
+		if err != nil {
+			return err
+		}
+		return fn(url)
+	})
+}
+
+// Reencrypt seals every URL that is plaintext or sealed with a rotated key
+// with the current key, and returns how many links were rewritten.
+func (e *EncryptedStorage) Reencrypt(ctx context.Context, progress func(rewritten int)) (int, error) {
+	rewritten := 0
+	err := e.Storage.Iterate(ctx, func(url ShortURL) error {
+		if sealedKeyID(url.OriginURL) == e.keys[0].id {
+			return nil
+		}
+		url, err := e.openURL(url)
+		if err != nil {
+			return fmt.Errorf("%s: %w", url.ID, err)
+		}
+		if url, err = e.sealURL(url); err != nil {
+			return err
+		}
+		if err := e.Storage.Save(ctx, url); err != nil {
+			return err
+		}
+		rewritten++
+		if progress != nil && rewritten%progressEvery == 0 {
+			progress(rewritten)
+		}
+		return nil
+	})
+	return rewritten, err
+}
+
+func (e *EncryptedStorage) Unwrap() Storage {
+	return e.Storage
+}
+
+func (e *EncryptedStorage) Close() error {
+	if closer, ok := e.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// checkFree fails with ErrConflict if url is already shortened, sealed under
+// any key or in plaintext.
+func (e *EncryptedStorage) checkFree(ctx context.Context, url string) error {
+	_, err := e.GetByOriginalURL(ctx, url)
+	if err == nil {
+		return ErrConflict
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (e *EncryptedStorage) seal(key urlKey, url string) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	index := key.blindIndex(url)
+	wrapped, err := sealRandom(key.wrap, dataKey, []byte(key.id))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealRandom(aead, []byte(url), []byte(index))
+	if err != nil {
+		return "", err
+	}
+	return index + ":" + key.id + ":" + wrapped + ":" + sealed, nil
+}
+
+func (e *EncryptedStorage) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefix), ":")
+	if len(parts) != 4 {
+		return "", ErrMalformedCiphertext
+	}
+	key, err := e.key(parts[1])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openSealed(key.wrap, parts[2], []byte(key.id))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", ErrMalformedCiphertext
+	}
+	plain, err := openSealed(aead, parts[3], []byte(sealedPrefix+parts[0]))
+	return string(plain), err
+}
+
+func (e *EncryptedStorage) key(id string) (urlKey, error) {
+	for _, key := range e.keys {
+		if key.id == id {
+			return key, nil
+		}
+	}
+	return urlKey{}, fmt.Errorf("%w %q", ErrUnknownEncryptionKey, id)
+}
+
+func (e *EncryptedStorage) openURL(url ShortURL) (ShortURL, error) {
+	var err error
+	if url.OriginURL, err = e.open(url.OriginURL); err != nil {
+		return url, err
+	}
+	url.Title, err = e.open(url.Title)
+	return url, err
+}
+
+func (e *EncryptedStorage) sealURL(url ShortURL) (ShortURL, error) {
+	var err error
+	if url.OriginURL, err = e.seal(e.keys[0], url.OriginURL); err != nil {
+		return url, err
+	}
+	if url.Title != "" {
+		url.Title, err = e.seal(e.keys[0], url.Title)
+	}
+	return url, err
+}
+
+func (k urlKey) blindIndex(url string) string {
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(url))
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// blindIndex returns the blind index a URL sealed by EncryptedStorage starts
+// with, or nothing for any other value.
+func blindIndex(value string) string {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return ""
+	}
+	if end := strings.IndexByte(value[len(sealedPrefix):], ':'); end >= 0 {
+		return value[:len(sealedPrefix)+end]
+	}
+	return value
+}
+
+// lookupKey is what storages index a stored URL under: its blind index if it
+// is sealed, as the ciphertext differs on every write, or else the URL itself.
+func lookupKey(url string) string {
+	if index := blindIndex(url); index != "" {
+		return index
+	}
+	return url
+}
+
+func sealedKeyID(value string) string {
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefix), ":")
+	if !strings.HasPrefix(value, sealedPrefix) || len(parts) != 4 {
+		return ""
+	}
+	return parts[1]
+}
+
+func sealRandom(aead cipher.AEAD, plain, data []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, data)), nil
+}
+
+func openSealed(aead cipher.AEAD, value string, data []byte) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+	size := aead.NonceSize()
+	return aead.Open(nil, sealed[:size], sealed[size:], data)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey = EncryptionKey{ID: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")}
+	newKey = EncryptionKey{ID: "k2", Secret: []byte("fedcba9876543210fedcba9876543210")}
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	raw := newTestSQLite(t)
+	st, err := NewEncryptedStorage(raw, oldKey)
+	require.NoError(t, err)
+
+	id, err := st.Add(ctx, "https://internal.example.com/?token=secret", 1)
+	require.NoError(t, err)
+
+	stored, err := raw.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.OriginURL, "enc:v2:"))
+	assert.Equal(t, "k1", sealedKeyID(stored.OriginURL))
+	assert.NotContains(t, stored.OriginURL, "secret")
+
+	again, err := st.seal(st.keys[0], "https://internal.example.com/?token=secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, stored.OriginURL, again)
+	assert.Equal(t, blindIndex(stored.OriginURL), blindIndex(again))
+
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://internal.example.com/?token=secret", url.OriginURL)
+
+	url, err = st.SetTitle(ctx, id, "Secret report")
+	require.NoError(t, err)
+	assert.Equal(t, "Secret report", url.Title)
+	stored, err = raw.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Title, "enc:v2:"))
+	url, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Secret report", url.Title)
+
+	found, err := st.GetByOriginalURL(ctx, "https://internal.example.com/?token=secret")
+	require.NoError(t, err)
+	assert.Equal(t, id, found)
+
+	_, err = st.Add(ctx, "https://internal.example.com/?token=secret", 2)
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.net"}, {OriginURL: "https://example.net"}}, 1)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	urls, err := st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org", CorrelationID: "1"}}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.org", urls[0].OriginURL)
+	assert.Equal(t, "1", urls[0].CorrelationID)
+
+	userURLs, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"https://internal.example.com/?token=secret", "https://example.org"},
+		[]string{userURLs[0].OriginURL, userURLs[1].OriginURL})
+}
+
+func TestEncryptedStorage_Rotation(t *testing.T) {
+	ctx := context.Background()
+	raw := newTestSQLite(t)
+	require.NoError(t, raw.Save(ctx, ShortURL{ID: "plain", OriginURL: "https://example.com/plain", UserID: 1}))
+
+	old, err := NewEncryptedStorage(raw, oldKey)
+	require.NoError(t, err)
+	_, err = old.Add(ctx, "https://example.com/plain", 2)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	id, err := old.Add(ctx, "https://example.com/old", 1)
+	require.NoError(t, err)
+
+	rotated, err := NewEncryptedStorage(raw, newKey, oldKey)
+	require.NoError(t, err)
+	found, err := rotated.GetByOriginalURL(ctx, "https://example.com/old")
+	require.NoError(t, err)
+	assert.Equal(t, id, found)
+	_, err = rotated.Add(ctx, "https://example.com/old", 2)
+	assert.ErrorIs(t, err, ErrConflict)
+	found, err = rotated.GetByOriginalURL(ctx, "https://example.com/plain")
+	require.NoError(t, err)
+	assert.Equal(t, "plain", found)
+
+	rewritten, err := rotated.Reencrypt(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rewritten)
+
+	current, err := NewEncryptedStorage(raw, newKey)
+	require.NoError(t, err)
+	require.NoError(t, current.Iterate(ctx, func(url ShortURL) error {
+		assert.True(t, strings.HasPrefix(url.OriginURL, "https://example.com/"))
+		return nil
+	}))
+	stored, err := raw.GetByID(ctx, "plain")
+	require.NoError(t, err)
+	assert.Equal(t, "k2", sealedKeyID(stored.OriginURL))
+
+	_, err = old.GetByID(ctx, "plain")
+	assert.ErrorIs(t, err, ErrUnknownEncryptionKey)
+}
+
+func TestEncryptedStorage_BlindIndex(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	for name, raw := range map[string]Storage{"memory": NewMemoryStorage(), "redis": NewRedisStorage(client), "sqlite": newTestSQLite(t)} {
+		t.Run(name, func(t *testing.T) {
+			st, err := NewEncryptedStorage(raw, oldKey)
+			require.NoError(t, err)
+
+			id, err := st.Add(ctx, "https://example.com", 1)
+			require.NoError(t, err)
+			found, err := st.GetByOriginalURL(ctx, "https://example.com")
+			require.NoError(t, err)
+			assert.Equal(t, id, found)
+			_, err = st.Add(ctx, "https://example.com", 2)
+			assert.ErrorIs(t, err, ErrConflict)
+
+			_, err = st.UpdateURL(ctx, id, "https://example.org", 1)
+			require.NoError(t, err)
+			_, err = st.GetByOriginalURL(ctx, "https://example.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+			found, err = st.GetByOriginalURL(ctx, "https://example.org")
+			require.NoError(t, err)
+			assert.Equal(t, id, found)
+		})
+	}
+}
+
+func TestNewEncryptedStorage_InvalidKeys(t *testing.T) {
+	_, err := NewEncryptedStorage(NewMemoryStorage())
+	assert.ErrorIs(t, err, ErrNoEncryptionKey)
+	_, err = NewEncryptedStorage(NewMemoryStorage(), EncryptionKey{ID: "a:b", Secret: oldKey.Secret})
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+	_, err = NewEncryptedStorage(NewMemoryStorage(), EncryptionKey{ID: "short", Secret: []byte("x")})
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
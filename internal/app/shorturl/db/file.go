@@ -4,24 +4,98 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
-	"errors"
-	"math/rand"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+// fileRecord is one line of the log. An edit is logged as the new state of
+// the link with the revision it made; compaction folds the revisions into
+// History.
+type fileRecord struct {
+	ShortURL
+	Deleted  bool       `json:"deleted,omitempty"`
+	Revision *Revision  `json:"revision,omitempty"`
+	History  []Revision `json:"history,omitempty"`
+	// ResetHistory makes History replace the link's revisions even when empty.
+	ResetHistory bool `json:"reset_history,omitempty"`
+}
+
 type dbFile struct {
+	sync.RWMutex
 	filePath string
+	file     *os.File
+	fsync    bool
+
+	linkIndex
+	garbage int
+	idGen   IDGenerator
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
-func NewFileStorage(filePath string) *dbFile {
-	return &dbFile{
-		filePath: filePath,
+// NewFileStorage loads the log at filePath into memory and keeps it open for appends.
+// Deletions and edits are appended as new records; compaction rewrites the log
+// without them every compactInterval. Records torn by a crash are skipped.
+func NewFileStorage(filePath string, fsync bool, compactInterval time.Duration) (*dbFile, error) {
+	f := &dbFile{
+		filePath:  filePath,
+		fsync:     fsync,
+		linkIndex: newLinkIndex(),
+		idGen:     defaultIDGenerator(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err := readLines(filePath, func(data []byte) error {
+		var record fileRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("file storage: skipping torn record: %v", err)
+			f.garbage++
+			return nil
+		}
+		if record.Deleted {
+			if f.drop(record.ID) {
+				f.garbage++
+			}
+			f.garbage++
+			return nil
+		}
+		if f.put(record.ShortURL) {
+			f.garbage++
+		}
+		if record.History != nil || record.ResetHistory {
+			f.setHistory(record.ID, record.History)
+		}
+		if record.Revision != nil {
+			f.addRevision(record.ID, *record.Revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	if compactInterval > 0 {
+		go f.runCompaction(compactInterval)
+	} else {
+		close(f.done)
 	}
+	return f, nil
 }
 
 func (f *dbFile) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
 	for index, url := range urls {
-		id, err := f.Add(ctx, url.OriginURL, userID)
+		id, err := f.add(ShortURL{OriginURL: url.OriginURL, UserID: userID, Tags: url.Tags, Folder: url.Folder})
 		if err != nil {
 			return nil, err
 		}
@@ -31,150 +105,426 @@ func (f *dbFile) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32
 }
 
 func (f *dbFile) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	return f.add(ShortURL{OriginURL: url, UserID: userID})
+}
+
+// add logs sURL, labels included, under a new ID, unless its user already
+// shortened the URL.
+func (f *dbFile) add(sURL ShortURL) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if shortURL, ok := f.findByURLAndUserID(sURL.OriginURL, sURL.UserID); ok {
+		return shortURL.ID, nil
+	}
 
-	shortURL, err := f.GetByURLAndUserID(url, userID)
+	id, err := f.generateID(sURL.OriginURL)
 	if err != nil {
 		return "", err
 	}
+	sURL.ID, sURL.CreatedAt = id, time.Now()
+	if err := f.append(fileRecord{ShortURL: sURL}); err != nil {
+		return "", err
+	}
+	f.put(sURL)
+	return sURL.ID, nil
+}
 
-	if shortURL.ID != "" {
-		return shortURL.ID, nil
+func (f *dbFile) Save(ctx context.Context, url ShortURL) error {
+	f.Lock()
+	defer f.Unlock()
+
+	url.CorrelationID = ""
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	if err := f.append(fileRecord{ShortURL: url}); err != nil {
+		return err
+	}
+	if f.put(url) {
+		f.garbage++
 	}
+	return nil
+}
 
-	newID := f.generateID()
+func (f *dbFile) Insert(ctx context.Context, url ShortURL) error {
+	f.Lock()
+	defer f.Unlock()
 
-	sURL := ShortURL{
-		ID:        newID,
-		OriginURL: url,
-		UserID:    userID,
+	if _, ok := f.urls[url.ID]; ok {
+		return ErrIDTaken
+	}
+	if _, ok := f.idByOriginal(url.OriginURL); ok {
+		return ErrConflict
 	}
+	url.CorrelationID = ""
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	if err := f.append(fileRecord{ShortURL: url}); err != nil {
+		return err
+	}
+	f.put(url)
+	return nil
+}
 
-	file, err := os.OpenFile(f.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
-	if err != nil {
-		return "", err
+func (f *dbFile) Delete(ctx context.Context, id string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.urls[id]; !ok {
+		return ErrNotFound
+	}
+	if err := f.append(fileRecord{ShortURL: ShortURL{ID: id}, Deleted: true}); err != nil {
+		return err
 	}
-	defer file.Close()
+	f.drop(id)
+	f.garbage += 2
+	return nil
+}
 
-	data, err := json.Marshal(&sURL)
-	if err != nil {
-		return "", err
+func (f *dbFile) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	sURL, rev, ok := f.revise(id, url, editorID)
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	if err := f.append(fileRecord{ShortURL: sURL, Revision: &rev}); err != nil {
+		return ShortURL{}, err
 	}
+	f.put(sURL)
+	f.addRevision(id, rev)
+	f.garbage++
+	return sURL, nil
+}
 
-	writer := bufio.NewWriter(file)
-	if _, err := writer.Write(data); err != nil {
-		return "", err
+func (f *dbFile) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	if revs, ok := f.revisions(id); ok {
+		return revs, nil
 	}
-	if err := writer.WriteByte('\n'); err != nil {
-		return "", err
+	return nil, ErrNotFound
+}
+
+func (f *dbFile) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	f.Lock()
+	defer f.Unlock()
+
+	sURL, ok := f.urls[id]
+	if !ok {
+		return ErrNotFound
 	}
-	if err := writer.Flush(); err != nil {
-		return "", err
+	if err := f.append(fileRecord{ShortURL: sURL, History: revs, ResetHistory: true}); err != nil {
+		return err
 	}
+	f.setHistory(id, revs)
+	f.garbage++
+	return nil
+}
+
+func (f *dbFile) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	f.Lock()
+	defer f.Unlock()
 
-	return newID, nil
+	sURL, ok := f.urls[id]
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	sURL.Preview = preview
+	if err := f.append(fileRecord{ShortURL: sURL}); err != nil {
+		return ShortURL{}, err
+	}
+	f.put(sURL)
+	f.garbage++
+	return sURL, nil
 }
 
-func (f *dbFile) GetByOriginalURL(ctx context.Context, url string) (string, error) {
-	file, err := os.OpenFile(f.filePath, os.O_RDONLY|os.O_CREATE, 0777)
+func (f *dbFile) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	f.Lock()
+	defer f.Unlock()
 
-	if err != nil {
-		return "", err
+	sURL, ok := f.urls[id]
+	if !ok {
+		return ShortURL{}, ErrNotFound
 	}
+	sURL.Title = title
+	if err := f.append(fileRecord{ShortURL: sURL}); err != nil {
+		return ShortURL{}, err
+	}
+	f.put(sURL)
+	f.garbage++
+	return sURL, nil
+}
 
-	defer file.Close()
+func (f *dbFile) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	f.Lock()
+	defer f.Unlock()
 
-	scanner := bufio.NewScanner(file)
+	sURL, ok := f.urls[id]
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	sURL.Tags, sURL.Folder = tags, folder
+	if err := f.append(fileRecord{ShortURL: sURL}); err != nil {
+		return ShortURL{}, err
+	}
+	f.put(sURL)
+	f.garbage++
+	return sURL, nil
+}
 
-	for scanner.Scan() {
-		var sURL ShortURL
-		err := json.Unmarshal(scanner.Bytes(), &sURL)
-		if err != nil {
-			return "", err
-		}
-		if sURL.OriginURL == url {
-			return sURL.ID, nil
+func (f *dbFile) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	return countTags(f.userURLs(userID)), nil
+}
+
+func (f *dbFile) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	changed := retagAll(f.userURLs(userID), from, to)
+	for _, url := range changed {
+		if err := f.append(fileRecord{ShortURL: url}); err != nil {
+			return nil, err
 		}
+		f.put(url)
+		f.garbage++
 	}
-	return "", nil
+	return linkIDs(changed), nil
 }
 
-func (f *dbFile) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
-	file, err := os.OpenFile(f.filePath, os.O_RDONLY, 0777)
+func (f *dbFile) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	f.Lock()
+	defer f.Unlock()
 
-	if err != nil {
-		return nil, err
+	for id, n := range clicks {
+		url, ok := f.urls[id]
+		if !ok {
+			continue
+		}
+		url.Clicks += n
+		if err := f.append(fileRecord{ShortURL: url}); err != nil {
+			return err
+		}
+		f.urls[id] = url
+		f.garbage++
 	}
-	defer file.Close()
-	var resultUrls []ShortURL
-	scanner := bufio.NewScanner(file)
+	return nil
+}
 
-	for scanner.Scan() {
-		var sURL ShortURL
-		err := json.Unmarshal(scanner.Bytes(), &sURL)
-		if err != nil {
-			return nil, err
+func (f *dbFile) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	f.RLock()
+	urls := f.all()
+	f.RUnlock()
+
+	for _, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		if sURL.UserID == userID {
-			resultUrls = append(resultUrls, sURL)
+		if err := fn(url); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return resultUrls, nil
+func (f *dbFile) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	f.RLock()
+	urls := f.userURLs(userID)
+	f.RUnlock()
+	return iterateOldestFirst(ctx, urls, fn)
 }
 
-func (f *dbFile) GetByURLAndUserID(url string, userID uint32) (ShortURL, error) {
-	file, err := os.OpenFile(f.filePath, os.O_RDONLY|os.O_CREATE, 0777)
+func (f *dbFile) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	f.RLock()
+	defer f.RUnlock()
 
-	if err != nil {
-		return ShortURL{}, err
+	if id, ok := f.idByOriginal(url); ok {
+		return id, nil
 	}
+	return "", ErrNotFound
+}
 
-	defer file.Close()
+func (f *dbFile) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	f.RLock()
+	defer f.RUnlock()
 
-	scanner := bufio.NewScanner(file)
+	return f.userURLs(userID), nil
+}
 
-	for scanner.Scan() {
-		var sURL ShortURL
-		err := json.Unmarshal(scanner.Bytes(), &sURL)
-		if err != nil {
-			return ShortURL{}, err
-		}
-		if sURL.OriginURL == url && sURL.UserID == userID {
-			return sURL, nil
-		}
+func (f *dbFile) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	return filterURLs(f.userURLs(q.UserID), q)
+}
+
+func (f *dbFile) GetByURLAndUserID(url string, userID uint32) (ShortURL, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	if shortURL, ok := f.findByURLAndUserID(url, userID); ok {
+		return shortURL, nil
 	}
-	return ShortURL{}, nil
+	return ShortURL{}, ErrNotFound
 }
 
 func (f *dbFile) GetByID(ctx context.Context, id string) (ShortURL, error) {
-	file, err := os.OpenFile(f.filePath, os.O_RDONLY|os.O_CREATE, 0777)
+	f.RLock()
+	defer f.RUnlock()
+
+	if sURL, ok := f.urls[id]; ok {
+		return sURL, nil
+	}
+	return ShortURL{}, ErrNotFound
+}
+
+// Compact rewrites the log so it holds exactly one record per live link.
+func (f *dbFile) Compact() error {
+	f.Lock()
+	defer f.Unlock()
 
+	tmp, err := os.CreateTemp(filepath.Dir(f.filePath), filepath.Base(f.filePath)+".*")
 	if err != nil {
-		return ShortURL{}, err
+		return err
+	}
+	if err := f.writeLive(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.filePath); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := syncDir(filepath.Dir(f.filePath)); err != nil {
+		tmp.Close()
+		return err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
 
-	for scanner.Scan() {
-		var sURL ShortURL
-		err := json.Unmarshal(scanner.Bytes(), &sURL)
-		if err != nil {
-			return ShortURL{}, err
+	// The rewritten log stays open for appends, so nothing can fail after
+	// the rename and leave the storage without a log.
+	f.file.Close()
+	f.file = tmp
+	f.garbage = 0
+	return nil
+}
+
+func (f *dbFile) writeLive(file *os.File) error {
+	writer := bufio.NewWriter(file)
+	enc := json.NewEncoder(writer)
+	for _, url := range f.urls {
+		if err := enc.Encode(fileRecord{ShortURL: url, History: f.history[url.ID]}); err != nil {
+			return err
 		}
-		if sURL.ID == id {
-			return sURL, nil
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (f *dbFile) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.stop)
+		<-f.done
+
+		f.Lock()
+		defer f.Unlock()
+		f.closeErr = f.file.Close()
+	})
+	return f.closeErr
+}
+
+func (f *dbFile) runCompaction(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.RLock()
+			needed := f.garbage > 0 && f.garbage >= len(f.urls)/2
+			f.RUnlock()
+			if !needed {
+				continue
+			}
+			if err := f.Compact(); err != nil {
+				log.Printf("file storage compaction: %v", err)
+			}
+		case <-f.stop:
+			return
 		}
 	}
+}
 
-	return ShortURL{}, errors.New("short url not found")
+// open opens the log for appends, ending a torn last record first so the
+// next record starts on a line of its own.
+func (f *dbFile) open() error {
+	file, err := os.OpenFile(f.filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+			file.Close()
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	f.file = file
+	return nil
 }
 
-func (f *dbFile) generateID() string {
-	lenID := 6
-	chars := []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_")
-	uniqueRuneArray := make([]rune, lenID)
-	for i := range uniqueRuneArray {
-		uniqueRuneArray[i] = chars[rand.Intn(len(chars))]
+func (f *dbFile) append(record fileRecord) error {
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if f.fsync {
+		return f.file.Sync()
 	}
-	return string(uniqueRuneArray)
+	return nil
+}
+
+func (f *dbFile) SetIDGenerator(gen IDGenerator) {
+	f.idGen = gen
+}
+
+func (f *dbFile) generateID(url string) (string, error) {
+	return newID(f.idGen, url, func(id string) (bool, error) {
+		_, taken := f.urls[id]
+		return !taken, nil
+	})
 }
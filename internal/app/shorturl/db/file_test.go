@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStorage_ReopenAndCompact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.json")
+
+	st, err := NewFileStorage(path, true, 0)
+	require.NoError(t, err)
+	first, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	second, err := st.Add(ctx, "https://example.org", 1)
+	require.NoError(t, err)
+
+	again, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	assert.Equal(t, first, again)
+
+	require.NoError(t, st.Delete(ctx, first))
+	require.NoError(t, st.Save(ctx, ShortURL{ID: second, OriginURL: "https://example.net", UserID: 1}))
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path, false, 0)
+	require.NoError(t, err)
+	_, err = st.GetByID(ctx, first)
+	assert.ErrorIs(t, err, ErrNotFound)
+	id, err := st.GetByOriginalURL(ctx, "https://example.net")
+	require.NoError(t, err)
+	assert.Equal(t, second, id)
+	_, err = st.GetByOriginalURL(ctx, "https://example.org")
+	assert.ErrorIs(t, err, ErrNotFound)
+	url, err := st.GetByURLAndUserID("https://example.net", 1)
+	require.NoError(t, err)
+	assert.Equal(t, second, url.ID)
+	_, err = st.GetByURLAndUserID("https://example.net", 2)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, st.Compact())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+
+	urls, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 1)
+	require.NoError(t, st.Close())
+}
+
+func TestFileStorage_TornRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.json")
+
+	st, err := NewFileStorage(path, true, 0)
+	require.NoError(t, err)
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+	require.NoError(t, st.Close())
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"id":"torn","original_url":"https://exa`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	st, err = NewFileStorage(path, true, 0)
+	require.NoError(t, err)
+	_, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	other, err := st.Add(ctx, "https://example.org", 1)
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path, true, 0)
+	require.NoError(t, err)
+	defer st.Close()
+	_, err = st.GetByID(ctx, other)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_UpdateURL(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := NewBoltStorage(filepath.Join(dir, "urls.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	_, client := newTestRedis(t)
+	encrypted, err := NewEncryptedStorage(newTestSQLite(t), oldKey)
+	require.NoError(t, err)
+
+	storages := map[string]Storage{
+		"memory":    NewMemoryStorage(),
+		"file":      file,
+		"bolt":      bolt,
+		"sqlite":    newTestSQLite(t),
+		"redis":     NewRedisStorage(client),
+		"encrypted": encrypted,
+		"cached":    NewCachedStorage(NewMemoryStorage(), 10, time.Minute, time.Minute),
+		"sharded":   NewShardedStorage(Shard{Name: "a", Storage: NewMemoryStorage()}, Shard{Name: "b", Storage: NewMemoryStorage()}),
+		"migrating": NewMigratingStorage(NewMemoryStorage(), NewMemoryStorage()),
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			id, err := st.Add(ctx, "https://example.com/"+name+"/1", 1)
+			require.NoError(t, err)
+			_, err = st.GetByID(ctx, id)
+			require.NoError(t, err)
+
+			revs, err := st.GetHistory(ctx, id)
+			require.NoError(t, err)
+			assert.Empty(t, revs)
+
+			updated, err := st.UpdateURL(ctx, id, "https://example.com/"+name+"/2", 2)
+			require.NoError(t, err)
+			assert.Equal(t, "https://example.com/"+name+"/2", updated.OriginURL)
+			assert.Equal(t, uint32(1), updated.UserID)
+			_, err = st.UpdateURL(ctx, id, "https://example.com/"+name+"/3", 1)
+			require.NoError(t, err)
+
+			url, err := st.GetByID(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, "https://example.com/"+name+"/3", url.OriginURL)
+			found, err := st.GetByOriginalURL(ctx, "https://example.com/"+name+"/3")
+			require.NoError(t, err)
+			assert.Equal(t, id, found)
+			_, err = st.GetByOriginalURL(ctx, "https://example.com/"+name+"/1")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			revs, err = st.GetHistory(ctx, id)
+			require.NoError(t, err)
+			require.Len(t, revs, 2)
+			assert.Equal(t, Revision{Version: 1, OriginURL: "https://example.com/" + name + "/1", EditorID: 2}, withoutTime(revs[0]))
+			assert.Equal(t, Revision{Version: 2, OriginURL: "https://example.com/" + name + "/2", EditorID: 1}, withoutTime(revs[1]))
+			assert.False(t, revs[0].EditedAt.IsZero())
+
+			_, err = st.UpdateURL(ctx, "missing", "https://example.com", 1)
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = st.GetHistory(ctx, "missing")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			url, err = st.SetPreview(ctx, id, true)
+			require.NoError(t, err)
+			assert.True(t, url.Preview)
+			assert.Equal(t, "https://example.com/"+name+"/3", url.OriginURL)
+			url, err = st.GetByID(ctx, id)
+			require.NoError(t, err)
+			assert.True(t, url.Preview)
+			_, err = st.SetPreview(ctx, "missing", true)
+			assert.ErrorIs(t, err, ErrNotFound)
+			url, err = st.SetTitle(ctx, id, "Example")
+			require.NoError(t, err)
+			assert.Equal(t, "Example", url.Title)
+			assert.True(t, url.Preview)
+			url, err = st.GetByID(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, "Example", url.Title)
+
+			restored := []Revision{{Version: 1, OriginURL: "https://example.com/" + name + "/0", EditorID: 5, EditedAt: time.Now()}}
+			require.NoError(t, st.SetHistory(ctx, id, restored))
+			revs, err = st.GetHistory(ctx, id)
+			require.NoError(t, err)
+			require.Len(t, revs, 1)
+			assert.Equal(t, withoutTime(restored[0]), withoutTime(revs[0]))
+			require.NoError(t, st.SetHistory(ctx, id, nil))
+			revs, err = st.GetHistory(ctx, id)
+			require.NoError(t, err)
+			assert.Empty(t, revs)
+			assert.ErrorIs(t, st.SetHistory(ctx, "missing", restored), ErrNotFound)
+
+			require.NoError(t, st.Delete(ctx, id))
+			_, err = st.GetHistory(ctx, id)
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = st.SetPreview(ctx, id, false)
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestStorage_HistorySurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	memory, err := NewMemoryStorageWithSnapshot(filepath.Join(dir, "urls.snapshot"), 0)
+	require.NoError(t, err)
+
+	var ids []string
+	for _, st := range []Storage{file, memory} {
+		id, err := st.Add(ctx, "https://example.com/1", 1)
+		require.NoError(t, err)
+		_, err = st.UpdateURL(ctx, id, "https://example.com/2", 1)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	require.NoError(t, file.Compact())
+	require.NoError(t, memory.Snapshot())
+	_, err = file.UpdateURL(ctx, ids[0], "https://example.com/3", 1)
+	require.NoError(t, err)
+	_, err = memory.UpdateURL(ctx, ids[1], "https://example.com/3", 1)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	defer memory.Close()
+
+	file, err = NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	replayed, err := NewMemoryStorageWithSnapshot(filepath.Join(dir, "urls.snapshot"), 0)
+	require.NoError(t, err)
+
+	for index, st := range []Storage{file, replayed} {
+		revs, err := st.GetHistory(ctx, ids[index])
+		require.NoError(t, err)
+		require.Len(t, revs, 2)
+		assert.Equal(t, "https://example.com/2", revs[1].OriginURL)
+	}
+}
+
+func TestStorage_SetHistorySurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	memory, err := NewMemoryStorageWithSnapshot(filepath.Join(dir, "urls.snapshot"), 0)
+	require.NoError(t, err)
+
+	var ids []string
+	for _, st := range []Storage{file, memory} {
+		id, err := st.Add(ctx, "https://example.com/1", 1)
+		require.NoError(t, err)
+		_, err = st.UpdateURL(ctx, id, "https://example.com/2", 1)
+		require.NoError(t, err)
+		require.NoError(t, st.SetHistory(ctx, id, nil))
+		ids = append(ids, id)
+	}
+	require.NoError(t, file.Close())
+	defer memory.Close()
+
+	file, err = NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	replayed, err := NewMemoryStorageWithSnapshot(filepath.Join(dir, "urls.snapshot"), 0)
+	require.NoError(t, err)
+
+	for index, st := range []Storage{file, replayed} {
+		revs, err := st.GetHistory(ctx, ids[index])
+		require.NoError(t, err)
+		assert.Empty(t, revs)
+	}
+}
+
+func TestMigratingStorage_UpdateURLCopiesOldLink(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryStorage(), NewMemoryStorage()
+	id, err := from.Add(ctx, "https://example.com/1", 1)
+	require.NoError(t, err)
+
+	m := NewMigratingStorage(from, to)
+	_, err = m.UpdateURL(ctx, id, "https://example.com/2", 1)
+	require.NoError(t, err)
+
+	for _, st := range []Storage{from, to} {
+		url, err := st.GetByID(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/2", url.OriginURL)
+	}
+	revs, err := to.GetHistory(ctx, id)
+	require.NoError(t, err)
+	assert.Len(t, revs, 1)
+}
+
+func withoutTime(rev Revision) Revision {
+	rev.EditedAt = time.Time{}
+	return rev
+}
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	Base62Alphabet  = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	DefaultIDLength = 7
+
+	maxIDAttempts = 12
+	growIDAfter   = 3
+	maxIDLength   = 32
+)
+
+var (
+	ErrIDSpaceExhausted = errors.New("no free short id found")
+	ErrInvalidAlphabet  = errors.New("id alphabet must have at least two unique characters out of A-Z a-z 0-9 - . _ ~")
+	ErrInvalidIDLength  = errors.New("id length must be between 1 and 32")
+)
+
+// IDGenerator produces candidate short IDs. attempt counts earlier collisions
+// for the same link, so deterministic generators can derive another candidate.
+type IDGenerator interface {
+	Generate(url string, attempt int) (string, error)
+}
+
+// growingGenerator is implemented by generators that can lengthen their IDs
+// once collisions show the keyspace is filling up.
+type growingGenerator interface {
+	Grow()
+}
+
+// newID asks gen for candidates until claim takes one. claim reports false
+// when the ID is already in use.
+func newID(gen IDGenerator, url string, claim func(id string) (bool, error)) (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		if attempt > 0 && attempt%growIDAfter == 0 {
+			if g, ok := gen.(growingGenerator); ok {
+				g.Grow()
+			}
+		}
+		id, err := gen.Generate(url, attempt)
+		if err != nil {
+			return "", err
+		}
+		ok, err := claim(id)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	return "", ErrIDSpaceExhausted
+}
+
+// seededGenerator is implemented by generators that count up a sequence, so
+// they can resume after the IDs they issued before a restart.
+type seededGenerator interface {
+	seed(id string)
+}
+
+// SeedIDGenerator moves a sequence generator past the highest number among
+// the IDs in st; without it a restart would hand out the sequence from its
+// start again. Other generators are left as they are.
+func SeedIDGenerator(ctx context.Context, gen IDGenerator, st Storage) error {
+	seeder, ok := gen.(seededGenerator)
+	if !ok {
+		return nil
+	}
+	return st.Iterate(ctx, func(url ShortURL) error {
+		seeder.seed(url.ID)
+		return nil
+	})
+}
+
+func defaultIDGenerator() IDGenerator {
+	gen, _ := NewRandomIDGenerator(Base62Alphabet, DefaultIDLength)
+	return gen
+}
+
+type idLength struct {
+	n int32
+}
+
+func (l *idLength) get() int {
+	return int(atomic.LoadInt32(&l.n))
+}
+
+func (l *idLength) Grow() {
+	for {
+		n := atomic.LoadInt32(&l.n)
+		if n >= maxIDLength || atomic.CompareAndSwapInt32(&l.n, n, n+1) {
+			return
+		}
+	}
+}
+
+type randomIDGenerator struct {
+	idLength
+	alphabet string
+}
+
+// NewRandomIDGenerator draws IDs from crypto/rand, so they cannot be guessed
+// from one another.
+func NewRandomIDGenerator(alphabet string, length int) (*randomIDGenerator, error) {
+	if err := checkAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if err := checkLength(length); err != nil {
+		return nil, err
+	}
+	return &randomIDGenerator{idLength: idLength{n: int32(length)}, alphabet: alphabet}, nil
+}
+
+func (g *randomIDGenerator) Generate(url string, attempt int) (string, error) {
+	size := len(g.alphabet)
+	limit := 256 - 256%size
+	id := make([]byte, g.get())
+	buf := make([]byte, len(id)*2)
+	for i := 0; i < len(id); {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			id[i] = g.alphabet[int(b)%size]
+			i++
+			if i == len(id) {
+				break
+			}
+		}
+	}
+	return string(id), nil
+}
+
+type counterIDGenerator struct {
+	idLength
+	alphabet string
+	next     uint64
+}
+
+// NewCounterIDGenerator encodes a sequence number, padded to minLength.
+func NewCounterIDGenerator(alphabet string, start uint64, minLength int) (*counterIDGenerator, error) {
+	if err := checkAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if err := checkLength(minLength); err != nil {
+		return nil, err
+	}
+	return &counterIDGenerator{idLength: idLength{n: int32(minLength)}, alphabet: alphabet, next: start}, nil
+}
+
+func (g *counterIDGenerator) Generate(url string, attempt int) (string, error) {
+	n := atomic.AddUint64(&g.next, 1) - 1
+	return encodeID(n, g.alphabet, g.get()), nil
+}
+
+func (g *counterIDGenerator) seed(id string) {
+	if n, ok := decodeID(id, g.alphabet); ok {
+		g.skipPast(n)
+	}
+}
+
+func (g *counterIDGenerator) skipPast(n uint64) {
+	if n == math.MaxUint64 {
+		return
+	}
+	for {
+		next := atomic.LoadUint64(&g.next)
+		if n < next || atomic.CompareAndSwapUint64(&g.next, next, n+1) {
+			return
+		}
+	}
+}
+
+type hashidsIDGenerator struct {
+	counterIDGenerator
+	salt string
+}
+
+// NewHashidsIDGenerator encodes a sequence like Hashids: every number picks a
+// lottery character that reshuffles the salted alphabet, so consecutive IDs
+// look unrelated while staying unique.
+func NewHashidsIDGenerator(alphabet, salt string, start uint64, minLength int) (*hashidsIDGenerator, error) {
+	counter, err := NewCounterIDGenerator(shuffle(alphabet, salt), start, minLength)
+	if err != nil {
+		return nil, err
+	}
+	return &hashidsIDGenerator{counterIDGenerator: *counter, salt: salt}, nil
+}
+
+func (g *hashidsIDGenerator) Generate(url string, attempt int) (string, error) {
+	n := atomic.AddUint64(&g.next, 1) - 1
+	lottery := g.alphabet[n%uint64(len(g.alphabet))]
+	alphabet := shuffle(g.alphabet, string(lottery)+g.salt)
+	length := g.get() - 1
+	if length < 0 {
+		length = 0
+	}
+	return string(lottery) + encodeID(n, alphabet, length), nil
+}
+
+// seed only counts IDs whose lottery character matches the number they
+// decode to, which rules out most IDs this generator did not issue.
+func (g *hashidsIDGenerator) seed(id string) {
+	if id == "" || strings.IndexByte(g.alphabet, id[0]) < 0 {
+		return
+	}
+	n, ok := decodeID(id[1:], shuffle(g.alphabet, id[:1]+g.salt))
+	if ok && g.alphabet[n%uint64(len(g.alphabet))] == id[0] {
+		g.skipPast(n)
+	}
+}
+
+type hashIDGenerator struct {
+	idLength
+	alphabet string
+}
+
+// NewHashIDGenerator derives IDs from the URL itself, so the same link gets
+// the same code on every backend unless it is already taken.
+func NewHashIDGenerator(alphabet string, length int) (*hashIDGenerator, error) {
+	if err := checkAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if err := checkLength(length); err != nil {
+		return nil, err
+	}
+	return &hashIDGenerator{idLength: idLength{n: int32(length)}, alphabet: alphabet}, nil
+}
+
+func (g *hashIDGenerator) Generate(url string, attempt int) (string, error) {
+	data := url
+	if attempt > 0 {
+		data += "\x00" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(data))
+	n := new(big.Int).SetBytes(sum[:])
+	base := big.NewInt(int64(len(g.alphabet)))
+	mod := new(big.Int)
+	id := make([]byte, g.get())
+	for i := range id {
+		n.DivMod(n, base, mod)
+		id[i] = g.alphabet[mod.Int64()]
+	}
+	return string(id), nil
+}
+
+func checkAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return ErrInvalidAlphabet
+	}
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if !unreserved(c) || seen[c] {
+			return fmt.Errorf("%w: %q", ErrInvalidAlphabet, c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// unreserved reports whether c may appear in a URL path unescaped (RFC 3986).
+func unreserved(c rune) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func checkLength(length int) error {
+	if length < 1 || length > maxIDLength {
+		return fmt.Errorf("%w: %d", ErrInvalidIDLength, length)
+	}
+	return nil
+}
+
+// encodeID writes n in the given alphabet, left-padded with its zero digit.
+func encodeID(n uint64, alphabet string, minLength int) string {
+	base := uint64(len(alphabet))
+	var digits []byte
+	for {
+		digits = append(digits, alphabet[n%base])
+		n /= base
+		if n == 0 {
+			break
+		}
+	}
+	for len(digits) < minLength {
+		digits = append(digits, alphabet[0])
+	}
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
+
+// decodeID reverses encodeID. It fails on characters outside the alphabet
+// and on numbers that do not fit in 64 bits.
+func decodeID(id, alphabet string) (uint64, bool) {
+	if id == "" {
+		return 0, false
+	}
+	base := uint64(len(alphabet))
+	var n uint64
+	for i := 0; i < len(id); i++ {
+		digit := strings.IndexByte(alphabet, id[i])
+		if digit < 0 || n > (math.MaxUint64-uint64(digit))/base {
+			return 0, false
+		}
+		n = n*base + uint64(digit)
+	}
+	return n, true
+}
+
+// shuffle is the consistent shuffle used by Hashids.
+func shuffle(alphabet, salt string) string {
+	if salt == "" {
+		return alphabet
+	}
+	result := []byte(alphabet)
+	for i, v, p := len(result)-1, 0, 0; i > 0; i-- {
+		v %= len(salt)
+		n := int(salt[v])
+		p += n
+		j := (n + v + p) % i
+		result[i], result[j] = result[j], result[i]
+		v++
+	}
+	return string(result)
+}
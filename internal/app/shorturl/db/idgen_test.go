@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRandomIDGenerator(t *testing.T) {
+	gen, err := NewRandomIDGenerator("abc", 10)
+	require.NoError(t, err)
+
+	id, err := gen.Generate("https://example.com", 0)
+	require.NoError(t, err)
+	assert.Len(t, id, 10)
+	assert.Empty(t, strings.Trim(id, "abc"))
+
+	gen.Grow()
+	id, err = gen.Generate("https://example.com", 0)
+	require.NoError(t, err)
+	assert.Len(t, id, 11)
+
+	_, err = NewRandomIDGenerator("aa", 10)
+	assert.ErrorIs(t, err, ErrInvalidAlphabet)
+	for _, alphabet := range []string{"ab+", "ab/", "ab c", "ab%", "abé"} {
+		_, err = NewRandomIDGenerator(alphabet, 10)
+		assert.ErrorIs(t, err, ErrInvalidAlphabet, alphabet)
+	}
+	_, err = NewRandomIDGenerator("ab-._~", 10)
+	assert.NoError(t, err)
+	_, err = NewRandomIDGenerator("abc", 0)
+	assert.ErrorIs(t, err, ErrInvalidIDLength)
+	_, err = NewRandomIDGenerator("abc", 33)
+	assert.ErrorIs(t, err, ErrInvalidIDLength)
+}
+
+func TestCounterIDGenerator(t *testing.T) {
+	gen, err := NewCounterIDGenerator("01", 2, 4)
+	require.NoError(t, err)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := gen.Generate("", 0)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []string{"0010", "0011", "0100"}, ids)
+}
+
+func TestHashidsIDGenerator(t *testing.T) {
+	gen, err := NewHashidsIDGenerator(Base62Alphabet, "salt", 0, 5)
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id, err := gen.Generate("", 0)
+		require.NoError(t, err)
+		assert.Len(t, id, 5)
+		require.False(t, seen[id], id)
+		seen[id] = true
+	}
+
+	other, err := NewHashidsIDGenerator(Base62Alphabet, "pepper", 0, 5)
+	require.NoError(t, err)
+	first, _ := NewHashidsIDGenerator(Base62Alphabet, "salt", 0, 5)
+	a, _ := first.Generate("", 0)
+	b, _ := other.Generate("", 0)
+	assert.NotEqual(t, a, b)
+}
+
+func TestHashIDGenerator(t *testing.T) {
+	gen, err := NewHashIDGenerator(Base62Alphabet, 8)
+	require.NoError(t, err)
+
+	a, _ := gen.Generate("https://example.com", 0)
+	b, _ := gen.Generate("https://example.com", 0)
+	c, _ := gen.Generate("https://example.com", 1)
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+	assert.Len(t, a, 8)
+}
+
+func TestSeedIDGenerator(t *testing.T) {
+	ctx := context.Background()
+	newCounter := func() IDGenerator {
+		gen, _ := NewCounterIDGenerator(Base62Alphabet, 0, 3)
+		return gen
+	}
+	newHashids := func() IDGenerator {
+		gen, _ := NewHashidsIDGenerator(Base62Alphabet, "salt", 0, 5)
+		return gen
+	}
+	for name, newGen := range map[string]func() IDGenerator{"counter": newCounter, "hashids": newHashids} {
+		t.Run(name, func(t *testing.T) {
+			st := NewMemoryStorage()
+			st.SetIDGenerator(newGen())
+			for i := 0; i < 5; i++ {
+				_, err := st.Add(ctx, fmt.Sprintf("https://example.com/%d", i), 1)
+				require.NoError(t, err)
+			}
+
+			restarted := newGen()
+			require.NoError(t, SeedIDGenerator(ctx, restarted, st))
+			id, err := restarted.Generate("", 0)
+			require.NoError(t, err)
+			_, err = st.GetByID(ctx, id)
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			fresh := newGen()
+			for i := 0; i < 5; i++ {
+				_, err := fresh.Generate("", 0)
+				require.NoError(t, err)
+			}
+			expected, err := fresh.Generate("", 0)
+			require.NoError(t, err)
+			assert.Equal(t, expected, id)
+		})
+	}
+}
+
+func TestNewID_GrowsOnCollisions(t *testing.T) {
+	gen, err := NewRandomIDGenerator("ab", 1)
+	require.NoError(t, err)
+
+	id, err := newID(gen, "", func(id string) (bool, error) {
+		return len(id) > 2, nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, id, 3)
+
+	_, err = newID(gen, "", func(id string) (bool, error) {
+		return false, nil
+	})
+	assert.ErrorIs(t, err, ErrIDSpaceExhausted)
+}
+
+func TestStorage_SkipsTakenIDs(t *testing.T) {
+	ctx := context.Background()
+	bolt, err := NewBoltStorage(filepath.Join(t.TempDir(), "urls.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	_, client := newTestRedis(t)
+
+	storages := map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"bolt":   bolt,
+		"sqlite": newTestSQLite(t),
+		"redis":  NewRedisStorage(client),
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			gen, err := NewCounterIDGenerator(Base62Alphabet, 0, 3)
+			require.NoError(t, err)
+			st.(interface{ SetIDGenerator(IDGenerator) }).SetIDGenerator(gen)
+
+			require.NoError(t, st.Save(ctx, ShortURL{ID: "000", OriginURL: "https://example.com/taken", UserID: 1}))
+			id, err := st.Add(ctx, "https://example.com/"+name, 1)
+			require.NoError(t, err)
+			assert.Equal(t, "001", id)
+
+			urls, err := st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org/" + name}}, 1)
+			require.NoError(t, err)
+			assert.Equal(t, "002", urls[0].ID)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import "time"
+
+type linkIndex struct {
+	urls       map[string]ShortURL
+	byOriginal map[string]map[string]struct{}
+	byUser     map[uint32]map[string]struct{}
+	history    map[string][]Revision
+}
+
+func newLinkIndex() linkIndex {
+	return linkIndex{
+		urls:       make(map[string]ShortURL),
+		byOriginal: make(map[string]map[string]struct{}),
+		byUser:     make(map[uint32]map[string]struct{}),
+		history:    make(map[string][]Revision),
+	}
+}
+
+func (i *linkIndex) put(url ShortURL) bool {
+	replaced := i.remove(url.ID)
+	i.urls[url.ID] = url
+	key := lookupKey(url.OriginURL)
+	if i.byOriginal[key] == nil {
+		i.byOriginal[key] = make(map[string]struct{})
+	}
+	i.byOriginal[key][url.ID] = struct{}{}
+	if i.byUser[url.UserID] == nil {
+		i.byUser[url.UserID] = make(map[string]struct{})
+	}
+	i.byUser[url.UserID][url.ID] = struct{}{}
+	return replaced
+}
+
+func (i *linkIndex) remove(id string) bool {
+	url, ok := i.urls[id]
+	if !ok {
+		return false
+	}
+	delete(i.urls, id)
+	key := lookupKey(url.OriginURL)
+	delete(i.byOriginal[key], id)
+	if len(i.byOriginal[key]) == 0 {
+		delete(i.byOriginal, key)
+	}
+	delete(i.byUser[url.UserID], id)
+	if len(i.byUser[url.UserID]) == 0 {
+		delete(i.byUser, url.UserID)
+	}
+	return true
+}
+
+// revise builds the edit of link id to url without applying it.
+func (i *linkIndex) revise(id, url string, editorID uint32) (ShortURL, Revision, bool) {
+	sURL, ok := i.urls[id]
+	if !ok {
+		return ShortURL{}, Revision{}, false
+	}
+	rev := Revision{
+		Version:   len(i.history[id]) + 1,
+		OriginURL: sURL.OriginURL,
+		EditorID:  editorID,
+		EditedAt:  time.Now(),
+	}
+	sURL.OriginURL = url
+	return sURL, rev, true
+}
+
+func (i *linkIndex) addRevision(id string, rev Revision) {
+	i.history[id] = append(i.history[id], rev)
+}
+
+func (i *linkIndex) setHistory(id string, revs []Revision) {
+	if len(revs) == 0 {
+		delete(i.history, id)
+		return
+	}
+	i.history[id] = append([]Revision{}, revs...)
+}
+
+func (i *linkIndex) revisions(id string) ([]Revision, bool) {
+	if _, ok := i.urls[id]; !ok {
+		return nil, false
+	}
+	return append([]Revision{}, i.history[id]...), true
+}
+
+// drop removes link id together with its history.
+func (i *linkIndex) drop(id string) bool {
+	delete(i.history, id)
+	return i.remove(id)
+}
+
+func (i *linkIndex) idByOriginal(url string) (string, bool) {
+	for id := range i.byOriginal[lookupKey(url)] {
+		return id, true
+	}
+	return "", false
+}
+
+func (i *linkIndex) findByURLAndUserID(url string, userID uint32) (ShortURL, bool) {
+	for id := range i.byOriginal[lookupKey(url)] {
+		if sURL := i.urls[id]; sURL.UserID == userID {
+			return sURL, true
+		}
+	}
+	return ShortURL{}, false
+}
+
+func (i *linkIndex) userURLs(userID uint32) []ShortURL {
+	var urls []ShortURL
+	for id := range i.byUser[userID] {
+		urls = append(urls, i.urls[id])
+	}
+	return urls
+}
+
+func (i *linkIndex) all() []ShortURL {
+	urls := make([]ShortURL, 0, len(i.urls))
+	for _, url := range i.urls {
+		urls = append(urls, url)
+	}
+	return urls
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_Insert(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := NewBoltStorage(filepath.Join(dir, "urls.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	_, client := newTestRedis(t)
+	encrypted, err := NewEncryptedStorage(newTestSQLite(t), oldKey)
+	require.NoError(t, err)
+
+	storages := map[string]Storage{
+		"memory":    NewMemoryStorage(),
+		"file":      file,
+		"bolt":      bolt,
+		"sqlite":    newTestSQLite(t),
+		"redis":     NewRedisStorage(client),
+		"encrypted": encrypted,
+		"cached":    NewCachedStorage(NewMemoryStorage(), 10, time.Minute, time.Minute),
+		"sharded":   NewShardedStorage(Shard{Name: "a", Storage: NewMemoryStorage()}, Shard{Name: "b", Storage: NewMemoryStorage()}),
+		"migrating": NewMigratingStorage(NewMemoryStorage(), NewMemoryStorage()),
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_, err := st.GetByID(ctx, "custom")
+			require.ErrorIs(t, err, ErrNotFound)
+
+			require.NoError(t, st.Insert(ctx, ShortURL{ID: "custom", OriginURL: "https://example.com/custom", UserID: 1, Tags: []string{"a"}}))
+			url, err := st.GetByID(ctx, "custom")
+			require.NoError(t, err)
+			assert.Equal(t, "https://example.com/custom", url.OriginURL)
+			assert.Equal(t, []string{"a"}, url.Tags)
+
+			err = st.Insert(ctx, ShortURL{ID: "custom", OriginURL: "https://example.com/other", UserID: 2})
+			assert.ErrorIs(t, err, ErrIDTaken)
+			err = st.Insert(ctx, ShortURL{ID: "another", OriginURL: "https://example.com/custom", UserID: 2})
+			assert.ErrorIs(t, err, ErrConflict)
+
+			url, err = st.GetByID(ctx, "custom")
+			require.NoError(t, err)
+			assert.Equal(t, uint32(1), url.UserID)
+			_, err = st.GetByID(ctx, "another")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestMigratingStorage_InsertChecksOldStorage(t *testing.T) {
+	ctx := context.Background()
+	from := NewMemoryStorage()
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "old", OriginURL: "https://example.com/old", UserID: 1}))
+	st := NewMigratingStorage(from, NewMemoryStorage())
+
+	assert.ErrorIs(t, st.Insert(ctx, ShortURL{ID: "old", OriginURL: "https://example.com/new"}), ErrIDTaken)
+	assert.ErrorIs(t, st.Insert(ctx, ShortURL{ID: "new", OriginURL: "https://example.com/old"}), ErrConflict)
+}
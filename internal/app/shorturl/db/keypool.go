@@ -0,0 +1,295 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const keyLease = 100
+
+var ErrDeterministicGenerator = errors.New("key pool needs a generator that does not derive ids from the url")
+
+// KeyStore keeps short IDs that were generated ahead of time and not yet used.
+type KeyStore interface {
+	Fill(ctx context.Context, ids []string) error
+	Take(ctx context.Context, n int) ([]string, error)
+	Count(ctx context.Context) (int, error)
+}
+
+// KeyPool hands out pre-generated IDs. Each instance leases a few keys at a
+// time from the store; keys leased but not used before a restart are dropped.
+// Once the store falls below lowWater it is refilled up to size in the
+// background, and IDs come straight from gen while the store is empty.
+type KeyPool struct {
+	store    KeyStore
+	gen      IDGenerator
+	size     int
+	lowWater int
+
+	mu        sync.Mutex
+	keys      []string
+	refilling int32
+}
+
+// NewKeyPool refuses the hash generator: keys are generated without a URL, so
+// it would fill the store with the same ID over and over.
+func NewKeyPool(store KeyStore, gen IDGenerator, size, lowWater int) (*KeyPool, error) {
+	if _, ok := gen.(*hashIDGenerator); ok {
+		return nil, ErrDeterministicGenerator
+	}
+	return &KeyPool{store: store, gen: gen, size: size, lowWater: lowWater}, nil
+}
+
+// Generate leases keys from the store without holding the lock, so a slow
+// store does not serialize every other caller behind it.
+func (k *KeyPool) Generate(url string, attempt int) (string, error) {
+	if id, ok := k.next(); ok {
+		return id, nil
+	}
+	lease := keyLease
+	if lease > k.size {
+		lease = k.size
+	}
+	keys, err := k.store.Take(context.Background(), lease)
+	if err != nil {
+		return "", err
+	}
+	k.refillBelowLowWater()
+	if len(keys) == 0 {
+		return k.gen.Generate(url, attempt)
+	}
+
+	k.mu.Lock()
+	k.keys = append(k.keys, keys[1:]...)
+	k.mu.Unlock()
+	return keys[0], nil
+}
+
+// Grow lengthens the IDs of later refills and of the fallback generator.
+func (k *KeyPool) Grow() {
+	if g, ok := k.gen.(growingGenerator); ok {
+		g.Grow()
+	}
+}
+
+func (k *KeyPool) next() (string, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.keys) == 0 {
+		return "", false
+	}
+	id := k.keys[0]
+	k.keys = k.keys[1:]
+	return id, true
+}
+
+// Refill tops the store up to size with fresh IDs from gen.
+func (k *KeyPool) Refill(ctx context.Context) (int, error) {
+	count, err := k.store.Count(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if count >= k.size {
+		return 0, nil
+	}
+	ids := make([]string, 0, k.size-count)
+	for len(ids) < cap(ids) {
+		id, err := k.gen.Generate("", 0)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	return len(ids), k.store.Fill(ctx, ids)
+}
+
+func (k *KeyPool) refillBelowLowWater() {
+	if !atomic.CompareAndSwapInt32(&k.refilling, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&k.refilling, 0)
+		ctx := context.Background()
+		count, err := k.store.Count(ctx)
+		if err == nil && count < k.lowWater {
+			_, err = k.Refill(ctx)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+type sqlKeyStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// KeyStore keeps the key pool in the short_keys table. IDs already used by a
+// link are never added.
+func (p *dbSQL) KeyStore() KeyStore {
+	return &sqlKeyStore{db: p.db, dialect: p.dialect}
+}
+
+func (s *sqlKeyStore) Fill(ctx context.Context, ids []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO short_keys (id) SELECT CAST($1 AS varchar(250))
+		WHERE NOT EXISTS (SELECT 1 FROM urls WHERE shorturl = $1) ON CONFLICT (id) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		if _, err := stmt.ExecContext(ctx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlKeyStore) Take(ctx context.Context, n int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "DELETE FROM short_keys WHERE id IN (SELECT id FROM short_keys LIMIT $1"+
+		s.dialect.skipLocked()+") RETURNING id", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlKeyStore) Count(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM short_keys").Scan(&count)
+	return count, err
+}
+
+type fileKeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys []string
+	st   Storage
+}
+
+// NewFileKeyStore keeps the key pool in a file with one ID per line. IDs
+// already used by a link in st are never added.
+func NewFileKeyStore(path string, st Storage) (*fileKeyStore, error) {
+	s := &fileKeyStore{path: path, st: st}
+	err := readLines(path, func(data []byte) error {
+		if len(data) > 0 {
+			s.keys = append(s.keys, string(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Fill checks ids against the storage before taking the lock: the storage
+// may be generating an ID, and so waiting on Take, at the same time.
+func (s *fileKeyStore) Fill(ctx context.Context, ids []string) error {
+	free := make([]string, 0, len(ids))
+	for _, id := range ids {
+		_, err := s.st.GetByID(ctx, id)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		free = append(free, id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool, len(s.keys))
+	for _, id := range s.keys {
+		seen[id] = true
+	}
+	keys := s.keys
+	for _, id := range free {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		keys = append(keys, id)
+	}
+	if err := s.write(keys); err != nil {
+		return err
+	}
+	s.keys = keys
+	return nil
+}
+
+func (s *fileKeyStore) Take(ctx context.Context, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.keys) {
+		n = len(s.keys)
+	}
+	if err := s.write(s.keys[n:]); err != nil {
+		return nil, err
+	}
+	ids := append([]string(nil), s.keys[:n]...)
+	s.keys = s.keys[n:]
+	return ids, nil
+}
+
+func (s *fileKeyStore) Count(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys), nil
+}
+
+func (s *fileKeyStore) write(keys []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if _, err := w.WriteString(strings.Join(keys, "\n")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyStores(t *testing.T) {
+	ctx := context.Background()
+	sqlite := newTestSQLite(t)
+	memory := NewMemoryStorage()
+	fileStore, err := NewFileKeyStore(filepath.Join(t.TempDir(), "keys"), memory)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		st    Storage
+		store KeyStore
+	}{
+		"sql":  {st: sqlite, store: sqlite.KeyStore()},
+		"file": {st: memory, store: fileStore},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, tc.st.Save(ctx, ShortURL{ID: "used", OriginURL: "https://example.com/" + name}))
+			require.NoError(t, tc.store.Fill(ctx, []string{"a", "b", "used", "a", "c"}))
+
+			count, err := tc.store.Count(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 3, count)
+
+			first, err := tc.store.Take(ctx, 2)
+			require.NoError(t, err)
+			rest, err := tc.store.Take(ctx, 5)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"a", "b", "c"}, append(first, rest...))
+			assert.Len(t, first, 2)
+
+			count, err = tc.store.Count(ctx)
+			require.NoError(t, err)
+			assert.Zero(t, count)
+		})
+	}
+}
+
+func TestFileKeyStore_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys")
+	store, err := NewFileKeyStore(path, NewMemoryStorage())
+	require.NoError(t, err)
+	require.NoError(t, store.Fill(ctx, []string{"a", "b", "c"}))
+	_, err = store.Take(ctx, 1)
+	require.NoError(t, err)
+
+	reopened, err := NewFileKeyStore(path, NewMemoryStorage())
+	require.NoError(t, err)
+	ids, err := reopened.Take(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, ids)
+}
+
+func TestKeyPool(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+	store, err := NewFileKeyStore(filepath.Join(t.TempDir(), "keys"), st)
+	require.NoError(t, err)
+	gen, err := NewCounterIDGenerator(Base62Alphabet, 0, 4)
+	require.NoError(t, err)
+
+	pool, err := NewKeyPool(store, gen, 10, 5)
+	require.NoError(t, err)
+	id, err := pool.Generate("https://example.com", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "0000", id, "empty pool falls back to the generator")
+
+	assert.Eventually(t, func() bool {
+		count, _ := store.Count(ctx)
+		return count == 10
+	}, time.Second, 10*time.Millisecond)
+
+	st.SetIDGenerator(pool)
+	seen := map[string]bool{id: true}
+	for i := 0; i < 20; i++ {
+		id, err := st.Add(ctx, "https://example.com", 1)
+		require.NoError(t, err)
+		require.False(t, seen[id], id)
+		seen[id] = true
+	}
+}
+
+func TestKeyPool_Generators(t *testing.T) {
+	store, err := NewFileKeyStore(filepath.Join(t.TempDir(), "keys"), NewMemoryStorage())
+	require.NoError(t, err)
+
+	hash, err := NewHashIDGenerator(Base62Alphabet, 4)
+	require.NoError(t, err)
+	_, err = NewKeyPool(store, hash, 10, 5)
+	assert.ErrorIs(t, err, ErrDeterministicGenerator)
+
+	random, err := NewRandomIDGenerator(Base62Alphabet, 4)
+	require.NoError(t, err)
+	pool, err := NewKeyPool(store, random, 10, 5)
+	require.NoError(t, err)
+	pool.Grow()
+	id, err := random.Generate("", 0)
+	require.NoError(t, err)
+	assert.Len(t, id, 5)
+}
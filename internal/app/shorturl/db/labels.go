@@ -0,0 +1,128 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTags         = 20
+	maxTagLength    = 64
+	maxFolderLength = 128
+)
+
+var ErrInvalidLabel = errors.New("invalid tag or folder")
+
+// TagCount is a tag and the number of the user's links carrying it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTags trims and lower-cases tags and drops duplicates, so filters
+// match regardless of how a tag was typed. It returns nil for no tags.
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	var result []string
+	for _, tag := range tags {
+		tag, err := NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	if len(result) > maxTags {
+		return nil, ErrInvalidLabel
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// NormalizeTag rejects empty or overlong tags and ones with commas, slashes
+// or control characters, which would be ambiguous in query strings and paths.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength || strings.ContainsAny(tag, ",/") || strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+		return "", ErrInvalidLabel
+	}
+	return tag, nil
+}
+
+// NormalizeFolder trims the folder name; an empty one means no folder.
+func NormalizeFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(folder)
+	if len(folder) > maxFolderLength || strings.IndexFunc(folder, unicode.IsControl) >= 0 {
+		return "", ErrInvalidLabel
+	}
+	return folder, nil
+}
+
+func hasTag(url ShortURL, tag string) bool {
+	for _, t := range url.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// retag replaces tag from with to on url, merging it with an existing to.
+func retag(url ShortURL, from, to string) (ShortURL, bool) {
+	if !hasTag(url, from) {
+		return url, false
+	}
+	tags := make([]string, 0, len(url.Tags))
+	for _, tag := range url.Tags {
+		if tag != from && tag != to {
+			tags = append(tags, tag)
+		}
+	}
+	url.Tags = append(tags, to)
+	sort.Strings(url.Tags)
+	return url, true
+}
+
+// retagAll returns the links of urls that carry from, with it renamed to to.
+func retagAll(urls []ShortURL, from, to string) []ShortURL {
+	var changed []ShortURL
+	for _, url := range urls {
+		if url, ok := retag(url, from, to); ok {
+			changed = append(changed, url)
+		}
+	}
+	return changed
+}
+
+func countTags(urls []ShortURL) []TagCount {
+	counts := make(map[string]int)
+	for _, url := range urls {
+		for _, tag := range url.Tags {
+			counts[tag]++
+		}
+	}
+	return tagCounts(counts)
+}
+
+func tagCounts(counts map[string]int) []TagCount {
+	result := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		result = append(result, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Tag < result[j].Tag
+	})
+	return result
+}
+
+func linkIDs(urls []ShortURL) []string {
+	ids := make([]string, len(urls))
+	for index, url := range urls {
+		ids[index] = url.ID
+	}
+	return ids
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := NormalizeTags([]string{" Promo ", "q4", "promo", "Black Friday"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"black friday", "promo", "q4"}, tags)
+
+	tags, err = NormalizeTags(nil)
+	require.NoError(t, err)
+	assert.Nil(t, tags)
+
+	for _, tag := range []string{"", "  ", "a,b", "a/b", "a\nb", strings.Repeat("a", maxTagLength+1)} {
+		_, err := NormalizeTags([]string{tag})
+		assert.ErrorIs(t, err, ErrInvalidLabel, "%q", tag)
+	}
+	_, err = NormalizeFolder(" Campaigns ")
+	assert.NoError(t, err)
+}
+
+func TestStorage_Labels(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := NewBoltStorage(filepath.Join(dir, "urls.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	_, client := newTestRedis(t)
+	encrypted, err := NewEncryptedStorage(newTestSQLite(t), oldKey)
+	require.NoError(t, err)
+
+	storages := map[string]Storage{
+		"memory":    NewMemoryStorage(),
+		"file":      file,
+		"bolt":      bolt,
+		"sqlite":    newTestSQLite(t),
+		"redis":     NewRedisStorage(client),
+		"encrypted": encrypted,
+		"cached":    NewCachedStorage(NewMemoryStorage(), 10, time.Minute, time.Minute),
+		"sharded":   NewShardedStorage(Shard{Name: "a", Storage: NewMemoryStorage()}, Shard{Name: "b", Storage: newTestSQLite(t)}),
+		"migrating": NewMigratingStorage(NewMemoryStorage(), NewMemoryStorage()),
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var ids []string
+			for _, path := range []string{"a", "b", "c"} {
+				id, err := st.Add(ctx, "https://example.com/"+name+"/"+path, 1)
+				require.NoError(t, err)
+				ids = append(ids, id)
+			}
+			other, err := st.Add(ctx, "https://example.com/"+name+"/other", 2)
+			require.NoError(t, err)
+
+			url, err := st.SetLabels(ctx, ids[0], []string{"promo", "q4"}, "Campaigns")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"promo", "q4"}, url.Tags)
+			assert.Equal(t, "https://example.com/"+name+"/a", url.OriginURL)
+			_, err = st.SetLabels(ctx, ids[1], []string{"q4"}, "")
+			require.NoError(t, err)
+			_, err = st.SetLabels(ctx, ids[2], []string{"promo"}, "Campaigns")
+			require.NoError(t, err)
+			_, err = st.SetLabels(ctx, other, []string{"promo"}, "Campaigns")
+			require.NoError(t, err)
+			_, err = st.SetLabels(ctx, "missing", nil, "")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			batch, err := st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.com/" + name + "/batch", Tags: []string{"new"}, Folder: "Inbox"}}, 3)
+			require.NoError(t, err)
+			url, err = st.GetByID(ctx, batch[0].ID)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"new"}, url.Tags)
+			assert.Equal(t, "Inbox", url.Folder)
+
+			url, err = st.GetByID(ctx, ids[0])
+			require.NoError(t, err)
+			assert.Equal(t, []string{"promo", "q4"}, url.Tags)
+			assert.Equal(t, "Campaigns", url.Folder)
+
+			page, err := st.ListURLs(ctx, URLQuery{UserID: 1, Tags: []string{"promo"}, Folder: "Campaigns", Sort: SortURLAsc})
+			require.NoError(t, err)
+			assert.Equal(t, []string{ids[0], ids[2]}, linkIDs(page.URLs))
+			page, err = st.ListURLs(ctx, URLQuery{UserID: 1, Tags: []string{"promo", "q4"}})
+			require.NoError(t, err)
+			assert.Equal(t, []string{ids[0]}, linkIDs(page.URLs))
+			assert.Equal(t, []string{"promo", "q4"}, page.URLs[0].Tags)
+
+			tags, err := st.ListTags(ctx, 1)
+			require.NoError(t, err)
+			assert.Equal(t, []TagCount{{Tag: "promo", Count: 2}, {Tag: "q4", Count: 2}}, tags)
+
+			renamed, err := st.RenameTag(ctx, 1, "q4", "promo")
+			require.NoError(t, err)
+			sort.Strings(renamed)
+			want := []string{ids[0], ids[1]}
+			sort.Strings(want)
+			assert.Equal(t, want, renamed)
+			tags, err = st.ListTags(ctx, 1)
+			require.NoError(t, err)
+			assert.Equal(t, []TagCount{{Tag: "promo", Count: 3}}, tags)
+			url, err = st.GetByID(ctx, ids[0])
+			require.NoError(t, err)
+			assert.Equal(t, []string{"promo"}, url.Tags)
+
+			tags, err = st.ListTags(ctx, 2)
+			require.NoError(t, err)
+			assert.Equal(t, []TagCount{{Tag: "promo", Count: 1}}, tags)
+
+			_, err = st.SetLabels(ctx, ids[0], nil, "")
+			require.NoError(t, err)
+			url, err = st.GetByID(ctx, ids[0])
+			require.NoError(t, err)
+			assert.Empty(t, url.Tags)
+			assert.Empty(t, url.Folder)
+
+			url, err = st.GetByID(ctx, ids[2])
+			require.NoError(t, err)
+			require.NoError(t, st.Delete(ctx, ids[2]))
+			require.NoError(t, st.Save(ctx, url))
+			url, err = st.GetByID(ctx, ids[2])
+			require.NoError(t, err)
+			assert.Equal(t, []string{"promo"}, url.Tags)
+			assert.Equal(t, "Campaigns", url.Folder)
+		})
+	}
+}
@@ -2,63 +2,65 @@ package db
 
 import (
 	"context"
-	"crypto/rand"
-	"errors"
-	"fmt"
-	"log"
 	"sync"
+	"time"
 )
 
 type dbMemory struct {
-	sync.Mutex
-	urls map[string]ShortURL
+	sync.RWMutex
+	linkIndex
+	idGen IDGenerator
+
+	snapshot *snapshotter
 }
 
 func NewMemoryStorage() *dbMemory {
 	return &dbMemory{
-		urls: make(map[string]ShortURL),
+		linkIndex: newLinkIndex(),
+		idGen:     defaultIDGenerator(),
 	}
 }
 
-func (d *dbMemory) generateID() string {
-	for {
-		b := make([]byte, 8)
-		_, err := rand.Read(b)
-		if err != nil {
-			log.Fatal(err)
-		}
-		newID := fmt.Sprintf("%x", b[0:8])
-		if _, ok := d.urls[newID]; !ok {
-			return newID
-		}
-	}
+func (d *dbMemory) SetIDGenerator(gen IDGenerator) {
+	d.idGen = gen
+}
+
+// generateID must be called with the write lock held, so the returned ID
+// stays free until it is stored.
+func (d *dbMemory) generateID(url string) (string, error) {
+	return newID(d.idGen, url, func(id string) (bool, error) {
+		_, taken := d.urls[id]
+		return !taken, nil
+	})
 }
 
 func (d *dbMemory) GetByOriginalURL(ctx context.Context, url string) (string, error) {
-	for _, itemMap := range d.urls {
-		if itemMap.OriginURL == url {
-			return itemMap.ID, nil
-		}
+	d.RLock()
+	defer d.RUnlock()
+
+	if id, ok := d.idByOriginal(url); ok {
+		return id, nil
 	}
-	return "", errors.New("short url not found")
+	return "", ErrNotFound
 }
 
 func (d *dbMemory) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
-	if d.urls == nil {
-		return []ShortURL{}, nil
-	}
-	var resultURLs []ShortURL
-	for _, itemMap := range d.urls {
-		if itemMap.UserID == userID {
-			resultURLs = append(resultURLs, itemMap)
-		}
-	}
-	return resultURLs, nil
+	d.RLock()
+	defer d.RUnlock()
+
+	return d.userURLs(userID), nil
+}
+
+func (d *dbMemory) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	return filterURLs(d.userURLs(q.UserID), q)
 }
 
 func (d *dbMemory) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
 	for index, url := range urls {
-		id, err := d.Add(ctx, url.OriginURL, userID)
+		id, err := d.add(ShortURL{OriginURL: url.OriginURL, UserID: userID, Tags: url.Tags, Folder: url.Folder})
 		if err != nil {
 			return nil, err
 		}
@@ -67,28 +69,236 @@ func (d *dbMemory) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint
 	return urls, nil
 }
 
+func (d *dbMemory) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	d.RLock()
+	urls := d.userURLs(userID)
+	d.RUnlock()
+	return iterateOldestFirst(ctx, urls, fn)
+}
+
 func (d *dbMemory) Add(ctx context.Context, url string, userID uint32) (string, error) {
-	if d.urls == nil {
-		d.Lock()
-		d.urls = make(map[string]ShortURL)
-		d.Unlock()
-	}
+	return d.add(ShortURL{OriginURL: url, UserID: userID})
+}
 
-	newID := d.generateID()
+// add stores sURL, labels included, under a new ID.
+func (d *dbMemory) add(sURL ShortURL) (string, error) {
 	d.Lock()
-	d.urls[newID] = ShortURL{
-		ID:        newID,
-		OriginURL: url,
-		UserID:    userID,
+	defer d.Unlock()
+
+	newID, err := d.generateID(sURL.OriginURL)
+	if err != nil {
+		return "", err
+	}
+	sURL.ID, sURL.CreatedAt = newID, time.Now()
+	if err := d.snapshot.put(sURL); err != nil {
+		return "", err
 	}
-	d.Unlock()
+	d.put(sURL)
 	return newID, nil
 }
 
 func (d *dbMemory) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	d.RLock()
+	defer d.RUnlock()
+
 	if ShortURL, ok := d.urls[id]; ok {
 		return ShortURL, nil
 	}
 
-	return ShortURL{}, errors.New("short url not found")
+	return ShortURL{}, ErrNotFound
+}
+
+func (d *dbMemory) Save(ctx context.Context, url ShortURL) error {
+	d.Lock()
+	defer d.Unlock()
+
+	url.CorrelationID = ""
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	if err := d.snapshot.put(url); err != nil {
+		return err
+	}
+	d.put(url)
+	return nil
+}
+
+func (d *dbMemory) Insert(ctx context.Context, url ShortURL) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.urls[url.ID]; ok {
+		return ErrIDTaken
+	}
+	if _, ok := d.idByOriginal(url.OriginURL); ok {
+		return ErrConflict
+	}
+	url.CorrelationID = ""
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	if err := d.snapshot.put(url); err != nil {
+		return err
+	}
+	d.put(url)
+	return nil
+}
+
+func (d *dbMemory) Delete(ctx context.Context, id string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.urls[id]; !ok {
+		return ErrNotFound
+	}
+	if err := d.snapshot.delete(id); err != nil {
+		return err
+	}
+	d.drop(id)
+	return nil
+}
+
+func (d *dbMemory) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	sURL, rev, ok := d.revise(id, url, editorID)
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	if err := d.snapshot.revise(sURL, rev); err != nil {
+		return ShortURL{}, err
+	}
+	d.put(sURL)
+	d.addRevision(id, rev)
+	return sURL, nil
+}
+
+func (d *dbMemory) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if revs, ok := d.revisions(id); ok {
+		return revs, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (d *dbMemory) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	d.Lock()
+	defer d.Unlock()
+
+	sURL, ok := d.urls[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := d.snapshot.setHistory(sURL, revs); err != nil {
+		return err
+	}
+	d.setHistory(id, revs)
+	return nil
+}
+
+func (d *dbMemory) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	sURL, ok := d.urls[id]
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	sURL.Preview = preview
+	if err := d.snapshot.put(sURL); err != nil {
+		return ShortURL{}, err
+	}
+	d.put(sURL)
+	return sURL, nil
+}
+
+func (d *dbMemory) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	sURL, ok := d.urls[id]
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	sURL.Title = title
+	if err := d.snapshot.put(sURL); err != nil {
+		return ShortURL{}, err
+	}
+	d.put(sURL)
+	return sURL, nil
+}
+
+func (d *dbMemory) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	sURL, ok := d.urls[id]
+	if !ok {
+		return ShortURL{}, ErrNotFound
+	}
+	sURL.Tags, sURL.Folder = tags, folder
+	if err := d.snapshot.put(sURL); err != nil {
+		return ShortURL{}, err
+	}
+	d.put(sURL)
+	return sURL, nil
+}
+
+func (d *dbMemory) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	return countTags(d.userURLs(userID)), nil
+}
+
+func (d *dbMemory) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	changed := retagAll(d.userURLs(userID), from, to)
+	for _, url := range changed {
+		if err := d.snapshot.put(url); err != nil {
+			return nil, err
+		}
+		d.put(url)
+	}
+	return linkIDs(changed), nil
+}
+
+// AddClicks skips links deleted since they were clicked.
+func (d *dbMemory) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for id, n := range clicks {
+		url, ok := d.urls[id]
+		if !ok {
+			continue
+		}
+		url.Clicks += n
+		if err := d.snapshot.put(url); err != nil {
+			return err
+		}
+		d.urls[id] = url
+	}
+	return nil
+}
+
+func (d *dbMemory) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	d.RLock()
+	urls := d.all()
+	d.RUnlock()
+
+	for _, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	return nil
 }
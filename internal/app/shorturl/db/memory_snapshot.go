@@ -0,0 +1,242 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type snapshotter struct {
+	path    string
+	journal *os.File
+	// seq numbers the journal entries; the snapshot records the last one it
+	// holds, so a journal left behind by a crash is not replayed twice.
+	seq  uint64
+	stop chan struct{}
+	done chan struct{}
+}
+
+type journalEntry struct {
+	Seq      uint64    `json:"seq,omitempty"`
+	URL      *ShortURL `json:"url,omitempty"`
+	Revision *Revision `json:"revision,omitempty"`
+	Deleted  string    `json:"deleted,omitempty"`
+	// History replaces the link's revisions when ResetHistory is set.
+	History      []Revision `json:"history,omitempty"`
+	ResetHistory bool       `json:"reset_history,omitempty"`
+}
+
+// snapshotRecord is a link, or the header line that carries JournalSeq.
+type snapshotRecord struct {
+	ShortURL
+	History    []Revision `json:"history,omitempty"`
+	JournalSeq uint64     `json:"journal_seq,omitempty"`
+}
+
+// NewMemoryStorageWithSnapshot restores the storage from the snapshot at path and
+// the journal of writes made after it, then snapshots again every interval.
+func NewMemoryStorageWithSnapshot(path string, interval time.Duration) (*dbMemory, error) {
+	d := NewMemoryStorage()
+
+	var seq uint64
+	err := readLines(path, func(data []byte) error {
+		var record snapshotRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if record.ID == "" {
+			seq = record.JournalSeq
+			return nil
+		}
+		d.put(record.ShortURL)
+		if record.History != nil {
+			d.history[record.ID] = record.History
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotSeq := seq
+	err = readLines(path+".journal", func(data []byte) error {
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("memory journal: skipping torn entry: %v", err)
+			return nil
+		}
+		if snapshotSeq > 0 && entry.Seq <= snapshotSeq {
+			return nil
+		}
+		if entry.Seq > seq {
+			seq = entry.Seq
+		}
+		switch {
+		case entry.URL != nil:
+			d.put(*entry.URL)
+			if entry.Revision != nil {
+				d.addRevision(entry.URL.ID, *entry.Revision)
+			}
+			if entry.ResetHistory {
+				d.setHistory(entry.URL.ID, entry.History)
+			}
+		default:
+			d.drop(entry.Deleted)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	d.snapshot = &snapshotter{
+		path:    path,
+		journal: journal,
+		seq:     seq,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go d.runSnapshots(interval)
+	} else {
+		close(d.snapshot.done)
+	}
+	return d, nil
+}
+
+func (d *dbMemory) runSnapshots(interval time.Duration) {
+	defer close(d.snapshot.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Snapshot(); err != nil {
+				log.Printf("memory snapshot: %v", err)
+			}
+		case <-d.snapshot.stop:
+			return
+		}
+	}
+}
+
+// Snapshot atomically replaces the snapshot file with the current contents and
+// truncates the journal. Writes are blocked while it runs.
+func (d *dbMemory) Snapshot() error {
+	if d.snapshot == nil {
+		return nil
+	}
+	d.RLock()
+	defer d.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.snapshot.path), filepath.Base(d.snapshot.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(writer)
+	if err := enc.Encode(snapshotRecord{JournalSeq: d.snapshot.seq}); err != nil {
+		return err
+	}
+	for _, url := range d.urls {
+		if err := enc.Encode(snapshotRecord{ShortURL: url, History: d.history[url.ID]}); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.snapshot.path); err != nil {
+		return err
+	}
+	return d.snapshot.journal.Truncate(0)
+}
+
+func (d *dbMemory) Close() error {
+	if d.snapshot == nil {
+		return nil
+	}
+	close(d.snapshot.stop)
+	<-d.snapshot.done
+	if err := d.Snapshot(); err != nil {
+		return err
+	}
+	return d.snapshot.journal.Close()
+}
+
+func (s *snapshotter) put(url ShortURL) error {
+	if s == nil {
+		return nil
+	}
+	return s.write(journalEntry{URL: &url})
+}
+
+func (s *snapshotter) revise(url ShortURL, rev Revision) error {
+	if s == nil {
+		return nil
+	}
+	return s.write(journalEntry{URL: &url, Revision: &rev})
+}
+
+func (s *snapshotter) setHistory(url ShortURL, revs []Revision) error {
+	if s == nil {
+		return nil
+	}
+	return s.write(journalEntry{URL: &url, History: revs, ResetHistory: true})
+}
+
+func (s *snapshotter) delete(id string) error {
+	if s == nil {
+		return nil
+	}
+	return s.write(journalEntry{Deleted: id})
+}
+
+func (s *snapshotter) write(entry journalEntry) error {
+	s.seq++
+	entry.Seq = s.seq
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.journal.Write(append(data, '\n'))
+	return err
+}
+
+func readLines(path string, fn func(data []byte) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
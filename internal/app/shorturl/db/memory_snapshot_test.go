@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStorage_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	st, err := NewMemoryStorageWithSnapshot(path, 0)
+	require.NoError(t, err)
+	first, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	st, err = NewMemoryStorageWithSnapshot(path, 0)
+	require.NoError(t, err)
+	second, err := st.Add(ctx, "https://example.org", 1)
+	require.NoError(t, err)
+	require.NoError(t, st.Delete(ctx, first))
+
+	crashed, err := NewMemoryStorageWithSnapshot(path, 0)
+	require.NoError(t, err)
+	_, err = crashed.GetByID(ctx, first)
+	assert.ErrorIs(t, err, ErrNotFound)
+	url, err := crashed.GetByID(ctx, second)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.org", url.OriginURL)
+}
+
+func TestMemoryStorage_SnapshotSkipsReplayedJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	st, err := NewMemoryStorageWithSnapshot(path, 0)
+	require.NoError(t, err)
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	_, err = st.UpdateURL(ctx, id, "https://example.org", 1)
+	require.NoError(t, err)
+
+	// A crash between the rename and the truncate leaves the journal behind.
+	journal, err := os.ReadFile(path + ".journal")
+	require.NoError(t, err)
+	require.NoError(t, st.Snapshot())
+	require.NoError(t, os.WriteFile(path+".journal", journal, 0666))
+
+	st, err = NewMemoryStorageWithSnapshot(path, 0)
+	require.NoError(t, err)
+	revs, err := st.GetHistory(ctx, id)
+	require.NoError(t, err)
+	assert.Len(t, revs, 1)
+
+	_, err = st.UpdateURL(ctx, id, "https://example.net", 1)
+	require.NoError(t, err)
+	crashed, err := NewMemoryStorageWithSnapshot(path, 0)
+	require.NoError(t, err)
+	revs, err = crashed.GetHistory(ctx, id)
+	require.NoError(t, err)
+	assert.Len(t, revs, 2)
+}
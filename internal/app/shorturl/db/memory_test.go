@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStorage_Indexes(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+
+	first, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	_, err = st.Add(ctx, "https://example.org", 2)
+	require.NoError(t, err)
+
+	id, err := st.GetByOriginalURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, first, id)
+
+	require.NoError(t, st.Save(ctx, ShortURL{ID: first, OriginURL: "https://example.net", UserID: 2}))
+	_, err = st.GetByOriginalURL(ctx, "https://example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	urls, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, urls)
+	urls, err = st.GetURLsByUserID(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+
+	require.NoError(t, st.Delete(ctx, first))
+	assert.ErrorIs(t, st.Delete(ctx, first), ErrNotFound)
+	urls, err = st.GetURLsByUserID(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, urls, 1)
+}
+
+func TestMemoryStorage_ConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+
+	const workers, perWorker = 16, 200
+	ids := make([][]string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				url := fmt.Sprintf("https://example.com/%d/%d", w, i)
+				id, err := st.Add(ctx, url, uint32(w))
+				if !assert.NoError(t, err) {
+					return
+				}
+				ids[w] = append(ids[w], id)
+
+				_, err = st.GetByID(ctx, id)
+				assert.NoError(t, err)
+				_, err = st.GetByOriginalURL(ctx, url)
+				assert.NoError(t, err)
+				_, err = st.GetURLsByUserID(ctx, uint32(w))
+				assert.NoError(t, err)
+				if i%10 == 0 {
+					assert.NoError(t, st.Delete(ctx, id))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[string]struct{})
+	for w := range ids {
+		for _, id := range ids[w] {
+			seen[id] = struct{}{}
+		}
+		urls, err := st.GetURLsByUserID(ctx, uint32(w))
+		require.NoError(t, err)
+		assert.Len(t, urls, perWorker-perWorker/10)
+	}
+	assert.Len(t, seen, workers*perWorker)
+}
@@ -0,0 +1,509 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+const progressEvery = 1000
+
+type MigrationProgress struct {
+	Total     int
+	Scanned   int
+	Copied    int
+	Conflicts int
+}
+
+// VerifyResult lists the links of the old storage that are not in the new
+// one. Conflicts are links whose URL the new storage already holds under
+// another ID, so they cannot be copied while its URLs are unique.
+type VerifyResult struct {
+	Checked    int
+	Missing    []string
+	Mismatched []string
+	Conflicts  []string
+}
+
+func (v VerifyResult) Parity() bool {
+	return len(v.Missing) == 0 && len(v.Mismatched) == 0 && len(v.Conflicts) == 0
+}
+
+type MigratingStorage struct {
+	from  Storage
+	to    Storage
+	idGen IDGenerator
+}
+
+func NewMigratingStorage(from, to Storage) *MigratingStorage {
+	return &MigratingStorage{from: from, to: to, idGen: defaultIDGenerator()}
+}
+
+// SetIDGenerator configures the target, which assigns IDs to new links.
+func (m *MigratingStorage) SetIDGenerator(gen IDGenerator) {
+	m.idGen = gen
+	if setter, ok := m.to.(interface{ SetIDGenerator(IDGenerator) }); ok {
+		setter.SetIDGenerator(gen)
+	}
+}
+
+func (m *MigratingStorage) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	return m.add(ctx, ShortURL{OriginURL: url, UserID: userID})
+}
+
+// add claims an ID that is free in both storages, as the old one may hold
+// links not backfilled yet.
+func (m *MigratingStorage) add(ctx context.Context, url ShortURL) (string, error) {
+	if _, err := m.from.GetByOriginalURL(ctx, url.OriginURL); err == nil {
+		return "", ErrConflict
+	} else if !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	url.CreatedAt = time.Now()
+	id, err := newID(m.idGen, url.OriginURL, func(id string) (bool, error) {
+		if _, err := m.from.GetByID(ctx, id); err == nil {
+			return false, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		url.ID = id
+		err := m.to.Insert(ctx, url)
+		if errors.Is(err, ErrIDTaken) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return "", err
+	}
+	m.saveOld(ctx, url)
+	return id, nil
+}
+
+// AddBatchURL adds the batch to the new storage in one go and then moves any
+// link whose ID turns out to be held in the old storage to a free one.
+func (m *MigratingStorage) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	for _, url := range urls {
+		if _, err := m.from.GetByOriginalURL(ctx, url.OriginURL); err == nil {
+			return nil, ErrConflict
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	urls, err := m.to.AddBatchURL(ctx, urls, userID)
+	if err != nil {
+		return nil, err
+	}
+	for index, url := range urls {
+		link := ShortURL{ID: url.ID, OriginURL: url.OriginURL, UserID: userID, Tags: url.Tags, Folder: url.Folder}
+		_, err := m.from.GetByID(ctx, url.ID)
+		if errors.Is(err, ErrNotFound) {
+			m.saveOld(ctx, link)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := m.to.Delete(ctx, url.ID); err != nil {
+			return nil, err
+		}
+		if urls[index].ID, err = m.add(ctx, link); err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+func (m *MigratingStorage) Save(ctx context.Context, url ShortURL) error {
+	if err := m.to.Save(ctx, url); err != nil {
+		return err
+	}
+	m.saveOld(ctx, url)
+	return nil
+}
+
+// Insert also checks the old storage, as the ID or URL may not have been
+// backfilled yet.
+func (m *MigratingStorage) Insert(ctx context.Context, url ShortURL) error {
+	if _, err := m.from.GetByID(ctx, url.ID); err == nil {
+		return ErrIDTaken
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if _, err := m.from.GetByOriginalURL(ctx, url.OriginURL); err == nil {
+		return ErrConflict
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := m.to.Insert(ctx, url); err != nil {
+		return err
+	}
+	m.saveOld(ctx, url)
+	return nil
+}
+
+func (m *MigratingStorage) Delete(ctx context.Context, id string) error {
+	errTo := m.to.Delete(ctx, id)
+	if errTo != nil && !errors.Is(errTo, ErrNotFound) {
+		return errTo
+	}
+	errFrom := m.from.Delete(ctx, id)
+	if errFrom != nil && !errors.Is(errFrom, ErrNotFound) {
+		return errFrom
+	}
+	if errTo != nil && errFrom != nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateURL edits the link in the new storage, copying it over first if it
+// has not been backfilled yet, so its history starts there.
+func (m *MigratingStorage) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	sURL, err := m.to.UpdateURL(ctx, id, url, editorID)
+	if errors.Is(err, ErrNotFound) {
+		old, err := m.from.GetByID(ctx, id)
+		if err != nil {
+			return ShortURL{}, err
+		}
+		if err := m.to.Save(ctx, old); err != nil {
+			return ShortURL{}, err
+		}
+		sURL, err = m.to.UpdateURL(ctx, id, url, editorID)
+		if err != nil {
+			return ShortURL{}, err
+		}
+	} else if err != nil {
+		return ShortURL{}, err
+	}
+	m.saveOld(ctx, sURL)
+	return sURL, nil
+}
+
+// SetLabels labels the link in the new storage, copying it over first like
+// UpdateURL does.
+func (m *MigratingStorage) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	sURL, err := m.to.SetLabels(ctx, id, tags, folder)
+	if errors.Is(err, ErrNotFound) {
+		old, err := m.from.GetByID(ctx, id)
+		if err != nil {
+			return ShortURL{}, err
+		}
+		old.Tags, old.Folder = tags, folder
+		if err := m.to.Save(ctx, old); err != nil {
+			return ShortURL{}, err
+		}
+		sURL = old
+	} else if err != nil {
+		return ShortURL{}, err
+	}
+	m.saveOld(ctx, sURL)
+	return sURL, nil
+}
+
+// SetPreview copies the link over first like UpdateURL does.
+func (m *MigratingStorage) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	sURL, err := m.to.SetPreview(ctx, id, preview)
+	if errors.Is(err, ErrNotFound) {
+		old, err := m.from.GetByID(ctx, id)
+		if err != nil {
+			return ShortURL{}, err
+		}
+		old.Preview = preview
+		if err := m.to.Save(ctx, old); err != nil {
+			return ShortURL{}, err
+		}
+		sURL = old
+	} else if err != nil {
+		return ShortURL{}, err
+	}
+	m.saveOld(ctx, sURL)
+	return sURL, nil
+}
+
+// SetTitle copies the link over first like UpdateURL does.
+func (m *MigratingStorage) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	sURL, err := m.to.SetTitle(ctx, id, title)
+	if errors.Is(err, ErrNotFound) {
+		old, err := m.from.GetByID(ctx, id)
+		if err != nil {
+			return ShortURL{}, err
+		}
+		old.Title = title
+		if err := m.to.Save(ctx, old); err != nil {
+			return ShortURL{}, err
+		}
+		sURL = old
+	} else if err != nil {
+		return ShortURL{}, err
+	}
+	m.saveOld(ctx, sURL)
+	return sURL, nil
+}
+
+func (m *MigratingStorage) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	urls, err := m.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return countTags(urls), nil
+}
+
+// RenameTag renames the tag in both storages, so links not backfilled yet
+// are not copied over with the old one.
+func (m *MigratingStorage) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	ids, err := m.to.RenameTag(ctx, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	oldIDs, err := m.from.RenameTag(ctx, userID, from, to)
+	if err != nil {
+		log.Printf("dual write of tag %s to old storage: %v", from, err)
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range oldIDs {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// AddClicks counts clicks in both storages, as a link may not have been
+// backfilled yet; links missing from either are skipped by it.
+func (m *MigratingStorage) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	if err := m.to.AddClicks(ctx, clicks); err != nil {
+		return err
+	}
+	if err := m.from.AddClicks(ctx, clicks); err != nil {
+		log.Printf("dual write of clicks to old storage: %v", err)
+	}
+	return nil
+}
+
+func (m *MigratingStorage) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	revs, err := m.to.GetHistory(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return m.from.GetHistory(ctx, id)
+	}
+	return revs, err
+}
+
+// SetHistory copies the link over first like UpdateURL does.
+func (m *MigratingStorage) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	err := m.to.SetHistory(ctx, id, revs)
+	if errors.Is(err, ErrNotFound) {
+		old, err := m.from.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := m.to.Save(ctx, old); err != nil {
+			return err
+		}
+		if err := m.to.SetHistory(ctx, id, revs); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := m.from.SetHistory(ctx, id, revs); err != nil {
+		log.Printf("dual write of %s history to old storage: %v", id, err)
+	}
+	return nil
+}
+
+func (m *MigratingStorage) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	url, err := m.to.GetByID(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return m.from.GetByID(ctx, id)
+	}
+	return url, err
+}
+
+func (m *MigratingStorage) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	id, err := m.to.GetByOriginalURL(ctx, url)
+	if errors.Is(err, ErrNotFound) {
+		return m.from.GetByOriginalURL(ctx, url)
+	}
+	return id, err
+}
+
+func (m *MigratingStorage) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	urls, err := m.to.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	oldURLs, err := m.from.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(urls))
+	for _, url := range urls {
+		seen[url.ID] = struct{}{}
+	}
+	for _, url := range oldURLs {
+		if _, ok := seen[url.ID]; !ok {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+func (m *MigratingStorage) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	urls, err := m.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return iterateOldestFirst(ctx, urls, fn)
+}
+
+func (m *MigratingStorage) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	urls, err := m.GetURLsByUserID(ctx, q.UserID)
+	if err != nil {
+		return URLPage{}, err
+	}
+	return filterURLs(urls, q)
+}
+
+func (m *MigratingStorage) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	seen := make(map[string]struct{})
+	err := m.to.Iterate(ctx, func(url ShortURL) error {
+		seen[url.ID] = struct{}{}
+		return fn(url)
+	})
+	if err != nil {
+		return err
+	}
+	return m.from.Iterate(ctx, func(url ShortURL) error {
+		if _, ok := seen[url.ID]; ok {
+			return nil
+		}
+		return fn(url)
+	})
+}
+
+// Backfill copies every link that exists only in the old storage into the new
+// one, history included. Links whose URL the new storage already holds under
+// another ID are skipped and counted as conflicts.
+func (m *MigratingStorage) Backfill(ctx context.Context, progress func(p MigrationProgress)) error {
+	var p MigrationProgress
+	err := m.from.Iterate(ctx, func(url ShortURL) error {
+		p.Total++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = m.from.Iterate(ctx, func(url ShortURL) error {
+		p.Scanned++
+		copied, err := m.copyOver(ctx, url)
+		switch {
+		case err == nil && copied:
+			p.Copied++
+		case errors.Is(err, ErrConflict):
+			log.Printf("backfill: skipped %s, %s is already shortened in the new storage", url.ID, url.OriginURL)
+			p.Conflicts++
+		case err != nil:
+			return err
+		}
+		if progress != nil && p.Scanned%progressEvery == 0 {
+			progress(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(p)
+	}
+	return nil
+}
+
+// copyOver inserts url into the new storage unless it is there already, which
+// is how a link edited or backfilled meanwhile is left alone. A link deleted
+// from the old storage while it was being copied is removed again, so the
+// copy does not bring it back.
+func (m *MigratingStorage) copyOver(ctx context.Context, url ShortURL) (bool, error) {
+	revs, err := m.from.GetHistory(ctx, url.ID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = m.to.Insert(ctx, url)
+	if errors.Is(err, ErrIDTaken) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(revs) > 0 {
+		if err := m.to.SetHistory(ctx, url.ID, revs); err != nil {
+			return false, err
+		}
+	}
+	if _, err := m.from.GetByID(ctx, url.ID); errors.Is(err, ErrNotFound) {
+		if err := m.to.Delete(ctx, url.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Verify checks that every link of the old storage is present in the new one with the same content.
+func (m *MigratingStorage) Verify(ctx context.Context) (VerifyResult, error) {
+	var result VerifyResult
+	err := m.from.Iterate(ctx, func(url ShortURL) error {
+		result.Checked++
+		newURL, err := m.to.GetByID(ctx, url.ID)
+		if errors.Is(err, ErrNotFound) {
+			_, err := m.to.GetByOriginalURL(ctx, url.OriginURL)
+			switch {
+			case err == nil:
+				result.Conflicts = append(result.Conflicts, url.ID)
+			case errors.Is(err, ErrNotFound):
+				result.Missing = append(result.Missing, url.ID)
+			default:
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if newURL.OriginURL != url.OriginURL || newURL.UserID != url.UserID {
+			result.Mismatched = append(result.Mismatched, url.ID)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (m *MigratingStorage) Close() error {
+	for _, st := range []Storage{m.to, m.from} {
+		if closer, ok := st.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MigratingStorage) saveOld(ctx context.Context, url ShortURL) {
+	if err := m.from.Save(ctx, url); err != nil {
+		log.Printf("dual write of %s to old storage: %v", url.ID, err)
+	}
+}
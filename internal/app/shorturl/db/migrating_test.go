@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMigratingStorage_Backfill(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryStorage(), NewMemoryStorage()
+
+	oldID, err := from.Add(ctx, "https://example.com/old", 1)
+	require.NoError(t, err)
+
+	st := NewMigratingStorage(from, to)
+	url, err := st.GetByID(ctx, oldID)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/old", url.OriginURL)
+
+	newID, err := st.Add(ctx, "https://example.com/new", 1)
+	require.NoError(t, err)
+	_, err = from.GetByID(ctx, newID)
+	assert.NoError(t, err)
+
+	result, err := st.Verify(ctx)
+	require.NoError(t, err)
+	assert.False(t, result.Parity())
+	assert.Equal(t, []string{oldID}, result.Missing)
+
+	var progress MigrationProgress
+	require.NoError(t, st.Backfill(ctx, func(p MigrationProgress) { progress = p }))
+	assert.Equal(t, MigrationProgress{Total: 2, Scanned: 2, Copied: 1}, progress)
+
+	result, err = st.Verify(ctx)
+	require.NoError(t, err)
+	assert.True(t, result.Parity())
+
+	urls, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+}
+
+func TestMigratingStorage_BackfillConflicts(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryStorage(), newTestSQLite(t)
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "first", OriginURL: "https://example.com", UserID: 1}))
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "second", OriginURL: "https://example.com", UserID: 2}))
+
+	st := NewMigratingStorage(from, to)
+	var progress MigrationProgress
+	require.NoError(t, st.Backfill(ctx, func(p MigrationProgress) { progress = p }))
+	assert.Equal(t, MigrationProgress{Total: 2, Scanned: 2, Copied: 1, Conflicts: 1}, progress)
+
+	result, err := st.Verify(ctx)
+	require.NoError(t, err)
+	assert.False(t, result.Parity())
+	assert.Empty(t, result.Missing)
+	assert.Len(t, result.Conflicts, 1)
+}
+
+// deleteOnInsert deletes each link from another storage while it is being
+// inserted, like a Delete racing a backfill.
+type deleteOnInsert struct {
+	Storage
+	from Storage
+}
+
+func (d deleteOnInsert) Insert(ctx context.Context, url ShortURL) error {
+	if err := d.from.Delete(ctx, url.ID); err != nil {
+		return err
+	}
+	return d.Storage.Insert(ctx, url)
+}
+
+func TestMigratingStorage_BackfillKeepsNewerLinks(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryStorage(), NewMemoryStorage()
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "edited", OriginURL: "https://example.com/1", UserID: 1}))
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "old", OriginURL: "https://example.com/old", UserID: 1}))
+	_, err := from.UpdateURL(ctx, "old", "https://example.com/old/2", 1)
+	require.NoError(t, err)
+
+	st := NewMigratingStorage(from, to)
+	_, err = st.UpdateURL(ctx, "edited", "https://example.com/2", 1)
+	require.NoError(t, err)
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "edited", OriginURL: "https://example.com/1", UserID: 1}))
+
+	var progress MigrationProgress
+	require.NoError(t, st.Backfill(ctx, func(p MigrationProgress) { progress = p }))
+	assert.Equal(t, MigrationProgress{Total: 2, Scanned: 2, Copied: 1}, progress)
+
+	url, err := to.GetByID(ctx, "edited")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/2", url.OriginURL)
+	revs, err := to.GetHistory(ctx, "old")
+	require.NoError(t, err)
+	require.Len(t, revs, 1)
+	assert.Equal(t, "https://example.com/old", revs[0].OriginURL)
+}
+
+func TestMigratingStorage_BackfillSkipsDeletedLinks(t *testing.T) {
+	ctx := context.Background()
+	from, to := NewMemoryStorage(), NewMemoryStorage()
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "old", OriginURL: "https://example.com/old", UserID: 1}))
+
+	st := NewMigratingStorage(from, deleteOnInsert{Storage: to, from: from})
+	var progress MigrationProgress
+	require.NoError(t, st.Backfill(ctx, func(p MigrationProgress) { progress = p }))
+	assert.Equal(t, MigrationProgress{Total: 1, Scanned: 1}, progress)
+	_, err := to.GetByID(ctx, "old")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMigratingStorage_AddSkipsOldIDs(t *testing.T) {
+	ctx := context.Background()
+	from := NewMemoryStorage()
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "000", OriginURL: "https://example.com/0", UserID: 1}))
+	require.NoError(t, from.Save(ctx, ShortURL{ID: "002", OriginURL: "https://example.com/2", UserID: 1}))
+	st := NewMigratingStorage(from, NewMemoryStorage())
+	gen, err := NewCounterIDGenerator(Base62Alphabet, 0, 3)
+	require.NoError(t, err)
+	st.SetIDGenerator(gen)
+
+	id, err := st.Add(ctx, "https://example.com/new", 2)
+	require.NoError(t, err)
+	assert.Equal(t, "001", id)
+	urls, err := st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.com/batch"}}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "003", urls[0].ID)
+
+	for _, id := range []string{"000", "002"} {
+		url, err := st.GetByID(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), url.UserID)
+	}
+	_, err = st.Add(ctx, "https://example.com/0", 2)
+	assert.ErrorIs(t, err, ErrConflict)
+}
@@ -1,8 +1,24 @@
 package db
 
+import "time"
+
 type ShortURL struct {
-	ID            string `json:"id"`
-	OriginURL     string `json:"origin_url"`
-	UserID        uint32 `json:"user_id"`
+	ID            string    `json:"id"`
+	OriginURL     string    `json:"origin_url"`
+	UserID        uint32    `json:"user_id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Tags          []string  `json:"tags,omitempty"`
+	Folder        string    `json:"folder,omitempty"`
+	Clicks        int64     `json:"clicks,omitempty"`
+	Preview       bool      `json:"preview,omitempty"`
+	Title         string    `json:"title,omitempty"`
 	CorrelationID string
 }
+
+// Revision records the destination a link had before an edit.
+type Revision struct {
+	Version   int       `json:"version"`
+	OriginURL string    `json:"origin_url"`
+	EditorID  uint32    `json:"editor_id"`
+	EditedAt  time.Time `json:"edited_at"`
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"log"
+	"time"
+)
+
+const LinksChannel = "shortener_links"
+
+const listenerPing = 90 * time.Second
+
+// ListenInvalidations evicts links changed by other instances from cache.
+// Notifications sent while the connection was down are lost, so the whole
+// cache is flushed after every reconnect.
+func ListenInvalidations(ctx context.Context, dsn string, cache *CachedStorage) error {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("links listener: %v", err)
+		}
+		if event == pq.ListenerEventReconnected {
+			cache.Flush()
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(LinksChannel); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(listenerPing)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				cache.Flush()
+				continue
+			}
+			cache.Invalidate(n.Extra)
+		case <-ticker.C:
+			go listener.Ping()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
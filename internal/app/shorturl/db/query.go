@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SortCreatedAsc  = "created_at"
+	SortCreatedDesc = "-created_at"
+	SortURLAsc      = "original_url"
+	SortURLDesc     = "-original_url"
+)
+
+var (
+	ErrInvalidSort   = errors.New("unknown sort order")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// URLQuery selects a page of a user's links. Search matches a substring of
+// the destination, ignoring case. Links must carry all of Tags and be in
+// Folder, if set. CreatedAfter is inclusive, CreatedBefore exclusive; zero
+// times are unbounded. A zero Limit returns every match.
+type URLQuery struct {
+	UserID        uint32
+	Search        string
+	Tags          []string
+	Folder        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string
+	Limit         int
+	Cursor        string
+}
+
+// URLPage is one page of links; NextCursor is empty on the last page.
+type URLPage struct {
+	URLs       []ShortURL
+	NextCursor string
+}
+
+type cursor struct {
+	Sort      string    `json:"s"`
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"c,omitempty"`
+	OriginURL string    `json:"u,omitempty"`
+}
+
+// normalize fills in the default sort and decodes the cursor.
+func (q *URLQuery) normalize() (*cursor, error) {
+	if q.Sort == "" {
+		q.Sort = SortCreatedDesc
+	}
+	switch q.Sort {
+	case SortCreatedAsc, SortCreatedDesc, SortURLAsc, SortURLDesc:
+	default:
+		return nil, ErrInvalidSort
+	}
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != q.Sort || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (q URLQuery) descending() bool {
+	return strings.HasPrefix(q.Sort, "-")
+}
+
+func (q URLQuery) byURL() bool {
+	return strings.HasSuffix(q.Sort, SortURLAsc)
+}
+
+func (q URLQuery) cursorAfter(url ShortURL) string {
+	c := cursor{Sort: q.Sort, ID: url.ID}
+	if q.byURL() {
+		c.OriginURL = url.OriginURL
+	} else {
+		c.CreatedAt = url.CreatedAt
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (q URLQuery) matches(url ShortURL) bool {
+	if url.UserID != q.UserID {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(strings.ToLower(url.OriginURL), strings.ToLower(q.Search)) {
+		return false
+	}
+	if q.Folder != "" && url.Folder != q.Folder {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(url, tag) {
+			return false
+		}
+	}
+	if !q.CreatedAfter.IsZero() && url.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	return q.CreatedBefore.IsZero() || url.CreatedAt.Before(q.CreatedBefore)
+}
+
+// less orders links by the query's sort, breaking ties by ID.
+func (q URLQuery) less(a, b ShortURL) bool {
+	var cmp int
+	if q.byURL() {
+		cmp = strings.Compare(a.OriginURL, b.OriginURL)
+	} else if a.CreatedAt.Before(b.CreatedAt) {
+		cmp = -1
+	} else if a.CreatedAt.After(b.CreatedAt) {
+		cmp = 1
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID, b.ID)
+	}
+	if q.descending() {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// page cuts a sorted list of matches after the cursor.
+func (q URLQuery) page(urls []ShortURL, c *cursor) URLPage {
+	if c != nil {
+		last := ShortURL{ID: c.ID, CreatedAt: c.CreatedAt, OriginURL: c.OriginURL}
+		start := sort.Search(len(urls), func(i int) bool {
+			return q.less(last, urls[i])
+		})
+		urls = urls[start:]
+	}
+	var page URLPage
+	if q.Limit > 0 && len(urls) > q.Limit {
+		urls = urls[:q.Limit]
+		page.NextCursor = q.cursorAfter(urls[len(urls)-1])
+	}
+	page.URLs = urls
+	return page
+}
+
+// iterateOldestFirst calls fn for urls in the order IterateUser promises.
+func iterateOldestFirst(ctx context.Context, urls []ShortURL, fn func(url ShortURL) error) error {
+	q := URLQuery{Sort: SortCreatedAsc}
+	sort.Slice(urls, func(i, j int) bool {
+		return q.less(urls[i], urls[j])
+	})
+	for _, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterURLs runs q over links loaded in memory.
+func filterURLs(urls []ShortURL, q URLQuery) (URLPage, error) {
+	c, err := q.normalize()
+	if err != nil {
+		return URLPage{}, err
+	}
+	matched := make([]ShortURL, 0, len(urls))
+	for _, url := range urls {
+		if q.matches(url) {
+			matched = append(matched, url)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.less(matched[i], matched[j])
+	})
+	return q.page(matched, c), nil
+}
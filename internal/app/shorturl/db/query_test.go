@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func ids(urls []ShortURL) []string {
+	result := make([]string, 0, len(urls))
+	for _, url := range urls {
+		result = append(result, url.ID)
+	}
+	return result
+}
+
+func TestStorage_ListURLs(t *testing.T) {
+	dir := t.TempDir()
+	bolt, err := NewBoltStorage(filepath.Join(dir, "urls.db"))
+	require.NoError(t, err)
+	defer bolt.Close()
+	file, err := NewFileStorage(filepath.Join(dir, "urls.log"), false, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	_, client := newTestRedis(t)
+	encrypted, err := NewEncryptedStorage(NewMemoryStorage(), oldKey)
+	require.NoError(t, err)
+
+	storages := map[string]Storage{
+		"memory":    NewMemoryStorage(),
+		"file":      file,
+		"bolt":      bolt,
+		"sqlite":    newTestSQLite(t),
+		"redis":     NewRedisStorage(client),
+		"encrypted": encrypted,
+		"sharded":   NewShardedStorage(Shard{Name: "a", Storage: NewMemoryStorage()}, Shard{Name: "b", Storage: newTestSQLite(t)}),
+		"migrating": NewMigratingStorage(NewMemoryStorage(), NewMemoryStorage()),
+	}
+	base := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	links := []ShortURL{
+		{ID: "a", OriginURL: "https://example.com/docs", UserID: 1, CreatedAt: base},
+		{ID: "b", OriginURL: "https://EXAMPLE.com/blog", UserID: 1, CreatedAt: base.Add(time.Hour)},
+		{ID: "c", OriginURL: "https://shop.test/50%_off", UserID: 1, CreatedAt: base.Add(2 * time.Hour)},
+		{ID: "d", OriginURL: "https://shop.test/500off", UserID: 1, CreatedAt: base.Add(3 * time.Hour)},
+		{ID: "e", OriginURL: "https://another.test", UserID: 1, CreatedAt: base.Add(4 * time.Hour)},
+		{ID: "f", OriginURL: "https://example.com/other-user", UserID: 2, CreatedAt: base},
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, link := range links {
+				require.NoError(t, st.Save(ctx, link))
+			}
+
+			var pages [][]string
+			q := URLQuery{UserID: 1, Limit: 2}
+			for i := 0; i < 5; i++ {
+				page, err := st.ListURLs(ctx, q)
+				require.NoError(t, err)
+				pages = append(pages, ids(page.URLs))
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+			assert.Equal(t, [][]string{{"e", "d"}, {"c", "b"}, {"a"}}, pages)
+
+			tests := []struct {
+				query URLQuery
+				want  []string
+			}{
+				{URLQuery{UserID: 1, Search: "example.COM"}, []string{"b", "a"}},
+				{URLQuery{UserID: 1, Search: "%_"}, []string{"c"}},
+				{URLQuery{UserID: 1, CreatedAfter: base.Add(time.Hour), CreatedBefore: base.Add(3 * time.Hour), Sort: SortCreatedAsc}, []string{"b", "c"}},
+				{URLQuery{UserID: 1, CreatedAfter: base.Add(time.Hour).In(time.FixedZone("x", 3600)), Sort: SortCreatedAsc, Limit: 1}, []string{"b"}},
+				{URLQuery{UserID: 1, Sort: SortURLAsc}, []string{"b", "e", "a", "c", "d"}},
+				{URLQuery{UserID: 1, Sort: SortURLDesc, Search: "shop"}, []string{"d", "c"}},
+				{URLQuery{UserID: 3}, nil},
+			}
+			for i, tt := range tests {
+				t.Run(fmt.Sprint(i), func(t *testing.T) {
+					page, err := st.ListURLs(ctx, tt.query)
+					require.NoError(t, err)
+					if tt.want == nil {
+						assert.Empty(t, page.URLs)
+						return
+					}
+					assert.Equal(t, tt.want, ids(page.URLs))
+				})
+			}
+
+			first, err := st.ListURLs(ctx, URLQuery{UserID: 1, Sort: SortURLAsc, Limit: 3})
+			require.NoError(t, err)
+			page, err := st.ListURLs(ctx, URLQuery{UserID: 1, Sort: SortURLAsc, Limit: 3, Cursor: first.NextCursor})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"c", "d"}, ids(page.URLs))
+			assert.Empty(t, page.NextCursor)
+
+			_, err = st.ListURLs(ctx, URLQuery{UserID: 1, Sort: "size"})
+			assert.ErrorIs(t, err, ErrInvalidSort)
+			_, err = st.ListURLs(ctx, URLQuery{UserID: 1, Cursor: "garbage"})
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+			_, err = st.ListURLs(ctx, URLQuery{UserID: 1, Sort: SortCreatedAsc, Cursor: first.NextCursor})
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+
+			var iterated []ShortURL
+			err = st.IterateUser(ctx, 1, func(url ShortURL) error {
+				iterated = append(iterated, url)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"a", "b", "c", "d", "e"}, ids(iterated))
+			assert.Equal(t, "https://example.com/docs", iterated[0].OriginURL)
+		})
+	}
+}
@@ -0,0 +1,643 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisScanCount = 500
+	redisTxRetries = 5
+)
+
+type dbRedis struct {
+	client *redis.Client
+	idGen  IDGenerator
+}
+
+func NewRedisStorage(client *redis.Client) *dbRedis {
+	return &dbRedis{client: client, idGen: defaultIDGenerator()}
+}
+
+func (r *dbRedis) SetIDGenerator(gen IDGenerator) {
+	r.idGen = gen
+}
+
+func (r *dbRedis) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	sURL := ShortURL{OriginURL: url, UserID: userID, CreatedAt: time.Now()}
+	if err := r.reserve(ctx, &sURL); err != nil {
+		return "", err
+	}
+	return sURL.ID, nil
+}
+
+func (r *dbRedis) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	for index, url := range urls {
+		sURL := ShortURL{OriginURL: url.OriginURL, UserID: userID, CreatedAt: time.Now(), Tags: url.Tags, Folder: url.Folder}
+		if err := r.reserve(ctx, &sURL); err != nil {
+			return nil, err
+		}
+		urls[index].ID = sURL.ID
+	}
+	return urls, nil
+}
+
+func (r *dbRedis) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	fields, err := r.client.HGetAll(ctx, redisLinkKey(id)).Result()
+	if err != nil {
+		return ShortURL{}, err
+	}
+	if len(fields) == 0 {
+		return ShortURL{}, ErrNotFound
+	}
+	return redisLink(id, fields)
+}
+
+func (r *dbRedis) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	id, err := r.client.SRandMember(ctx, redisOriginalKey(url)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+	return id, err
+}
+
+func (r *dbRedis) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	ids, err := r.client.SMembers(ctx, redisUserKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var urls []ShortURL
+	for _, id := range ids {
+		url, err := r.GetByID(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func (r *dbRedis) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	urls, err := r.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return iterateOldestFirst(ctx, urls, fn)
+}
+
+func (r *dbRedis) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	urls, err := r.GetURLsByUserID(ctx, q.UserID)
+	if err != nil {
+		return URLPage{}, err
+	}
+	return filterURLs(urls, q)
+}
+
+// Save replaces the link and its index entries in one transaction. Like
+// UpdateURL it watches the link, so a concurrent change makes it start over.
+func (r *dbRedis) Save(ctx context.Context, url ShortURL) error {
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, redisLinkKey(url.ID)).Result()
+		if err != nil {
+			return err
+		}
+		old, err := redisLink(url.ID, fields)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(fields) > 0 {
+				pipe.Del(ctx, redisLinkKey(url.ID))
+				pipe.SRem(ctx, redisUserKey(old.UserID), url.ID)
+				pipe.SRem(ctx, redisOriginalKey(old.OriginURL), url.ID)
+			}
+			redisIndex(ctx, pipe, url)
+			return nil
+		})
+		return err
+	}, redisLinkKey(url.ID))
+}
+
+// Insert watches the link and the URL's index entry; a concurrent write to
+// either makes it start over.
+func (r *dbRedis) Insert(ctx context.Context, url ShortURL) error {
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, redisLinkKey(url.ID)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrIDTaken
+		}
+		if n, err = tx.SCard(ctx, redisOriginalKey(url.OriginURL)).Result(); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			redisIndex(ctx, pipe, url)
+			return nil
+		})
+		return err
+	}, redisLinkKey(url.ID), redisOriginalKey(url.OriginURL))
+}
+
+func (r *dbRedis) Delete(ctx context.Context, id string) error {
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		url, err := redisTxLink(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, redisLinkKey(id), redisHistoryKey(id))
+			pipe.SRem(ctx, redisUserKey(url.UserID), id)
+			pipe.SRem(ctx, redisOriginalKey(url.OriginURL), id)
+			return nil
+		})
+		return err
+	}, redisLinkKey(id))
+}
+
+// UpdateURL watches the link and its history, so a concurrent edit makes it
+// start over instead of losing a revision.
+func (r *dbRedis) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	var sURL ShortURL
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		var err error
+		if sURL, err = redisTxLink(ctx, tx, id); err != nil {
+			return err
+		}
+		versions, err := tx.LLen(ctx, redisHistoryKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		rev, err := json.Marshal(Revision{Version: int(versions) + 1, OriginURL: sURL.OriginURL, EditorID: editorID, EditedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.RPush(ctx, redisHistoryKey(id), rev)
+			pipe.SRem(ctx, redisOriginalKey(sURL.OriginURL), id)
+			pipe.SAdd(ctx, redisOriginalKey(url), id)
+			pipe.HSet(ctx, redisLinkKey(id), "url", url)
+			return nil
+		})
+		sURL.OriginURL = url
+		return err
+	}, redisLinkKey(id), redisHistoryKey(id))
+	return sURL, err
+}
+
+func (r *dbRedis) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	if _, err := r.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+	values, err := r.client.LRange(ctx, redisHistoryKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]Revision, len(values))
+	for index, value := range values {
+		if err := json.Unmarshal([]byte(value), &revs[index]); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
+
+func (r *dbRedis) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	values := make([]interface{}, len(revs))
+	for index, rev := range revs {
+		data, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		values[index] = data
+	}
+	return r.watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, redisLinkKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, redisHistoryKey(id))
+			if len(values) > 0 {
+				pipe.RPush(ctx, redisHistoryKey(id), values...)
+			}
+			return nil
+		})
+		return err
+	}, redisLinkKey(id), redisHistoryKey(id))
+}
+
+// SetPreview watches the link, so a concurrent Delete is not undone by
+// writing the field of a removed hash.
+func (r *dbRedis) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, redisLinkKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, redisLinkKey(id), "preview", preview)
+			return nil
+		})
+		return err
+	}, redisLinkKey(id))
+	if err != nil {
+		return ShortURL{}, err
+	}
+	return r.GetByID(ctx, id)
+}
+
+func (r *dbRedis) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, redisLinkKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, redisLinkKey(id), "title", title)
+			return nil
+		})
+		return err
+	}, redisLinkKey(id))
+	if err != nil {
+		return ShortURL{}, err
+	}
+	return r.GetByID(ctx, id)
+}
+
+func (r *dbRedis) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	var sURL ShortURL
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		var err error
+		if sURL, err = redisTxLink(ctx, tx, id); err != nil {
+			return err
+		}
+		sURL.Tags, sURL.Folder = tags, folder
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, redisLinkKey(id), "tags", strings.Join(tags, ","), "folder", folder)
+			return nil
+		})
+		return err
+	}, redisLinkKey(id))
+	if err != nil {
+		return ShortURL{}, err
+	}
+	return sURL, nil
+}
+
+func (r *dbRedis) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	urls, err := r.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return countTags(urls), nil
+}
+
+// RenameTag watches the user's set and then each of the user's links before
+// reading it, so a link deleted or relabeled meanwhile makes it start over.
+func (r *dbRedis) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	var changed []ShortURL
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		ids, err := tx.SMembers(ctx, redisUserKey(userID)).Result()
+		if err != nil {
+			return err
+		}
+		var urls []ShortURL
+		for _, id := range ids {
+			if err := tx.Watch(ctx, redisLinkKey(id)).Err(); err != nil {
+				return err
+			}
+			url, err := redisTxLink(ctx, tx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			urls = append(urls, url)
+		}
+		changed = retagAll(urls, from, to)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, url := range changed {
+				pipe.HSet(ctx, redisLinkKey(url.ID), "tags", strings.Join(url.Tags, ","))
+			}
+			return nil
+		})
+		return err
+	}, redisUserKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	return linkIDs(changed), nil
+}
+
+// incrClicks only counts clicks of links that still exist, so a deleted link
+// is not brought back as a hash holding nothing but its clicks.
+var incrClicks = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HINCRBY", KEYS[1], "clicks", ARGV[1])
+end
+return 0
+`)
+
+func (r *dbRedis) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for id, n := range clicks {
+			incrClicks.Eval(ctx, pipe, []string{redisLinkKey(id)}, n)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *dbRedis) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	iter := r.client.Scan(ctx, 0, redisLinkKey("*"), redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		url, err := r.GetByID(ctx, iter.Val()[len(redisLinkKey("")):])
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (r *dbRedis) Close() error {
+	return r.client.Close()
+}
+
+// watch runs fn in a transaction on keys and starts it over, up to
+// redisTxRetries times, when a concurrent write to one of them aborts it.
+func (r *dbRedis) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 1; ; attempt++ {
+		err := r.client.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) || attempt == redisTxRetries {
+			return err
+		}
+	}
+}
+
+func redisTxLink(ctx context.Context, tx *redis.Tx, id string) (ShortURL, error) {
+	fields, err := tx.HGetAll(ctx, redisLinkKey(id)).Result()
+	if err != nil {
+		return ShortURL{}, err
+	}
+	if len(fields) == 0 {
+		return ShortURL{}, ErrNotFound
+	}
+	return redisLink(id, fields)
+}
+
+// reserve claims a free ID and stores the link under it in one transaction,
+// watching the candidate key so an ID claimed meanwhile is treated as taken.
+func (r *dbRedis) reserve(ctx context.Context, url *ShortURL) error {
+	id, err := newID(r.idGen, url.OriginURL, func(id string) (bool, error) {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			n, err := tx.Exists(ctx, redisLinkKey(id)).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return redis.TxFailedErr
+			}
+			link := *url
+			link.ID = id
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				redisIndex(ctx, pipe, link)
+				return nil
+			})
+			return err
+		}, redisLinkKey(id))
+		if errors.Is(err, redis.TxFailedErr) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	url.ID = id
+	return err
+}
+
+func redisIndex(ctx context.Context, pipe redis.Pipeliner, url ShortURL) {
+	pipe.HSet(ctx, redisLinkKey(url.ID), redisFields(url))
+	pipe.SAdd(ctx, redisUserKey(url.UserID), url.ID)
+	pipe.SAdd(ctx, redisOriginalKey(url.OriginURL), url.ID)
+}
+
+type redisCache struct {
+	Storage
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisCache serves GetByID from Redis, so several replicas share one
+// cache in front of the storage.
+func NewRedisCache(client *redis.Client, st Storage, ttl time.Duration) *redisCache {
+	return &redisCache{Storage: st, client: client, ttl: ttl}
+}
+
+func (c *redisCache) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	data, err := c.client.Get(ctx, redisCacheKey(id)).Bytes()
+	if err == nil {
+		var url ShortURL
+		if err := json.Unmarshal(data, &url); err == nil {
+			return url, nil
+		}
+	}
+
+	url, err := c.Storage.GetByID(ctx, id)
+	if err != nil {
+		return url, err
+	}
+	if data, err := json.Marshal(url); err == nil {
+		c.client.Set(ctx, redisCacheKey(id), data, c.ttl)
+	}
+	return url, nil
+}
+
+func (c *redisCache) Save(ctx context.Context, url ShortURL) error {
+	if err := c.Storage.Save(ctx, url); err != nil {
+		return err
+	}
+	return c.client.Del(ctx, redisCacheKey(url.ID)).Err()
+}
+
+func (c *redisCache) Insert(ctx context.Context, url ShortURL) error {
+	if err := c.Storage.Insert(ctx, url); err != nil {
+		return err
+	}
+	return c.client.Del(ctx, redisCacheKey(url.ID)).Err()
+}
+
+func (c *redisCache) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	sURL, err := c.Storage.UpdateURL(ctx, id, url, editorID)
+	if err != nil {
+		return sURL, err
+	}
+	return sURL, c.client.Del(ctx, redisCacheKey(id)).Err()
+}
+
+func (c *redisCache) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	sURL, err := c.Storage.SetPreview(ctx, id, preview)
+	if err != nil {
+		return sURL, err
+	}
+	return sURL, c.client.Del(ctx, redisCacheKey(id)).Err()
+}
+
+func (c *redisCache) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	sURL, err := c.Storage.SetTitle(ctx, id, title)
+	if err != nil {
+		return sURL, err
+	}
+	return sURL, c.client.Del(ctx, redisCacheKey(id)).Err()
+}
+
+func (c *redisCache) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	sURL, err := c.Storage.SetLabels(ctx, id, tags, folder)
+	if err != nil {
+		return sURL, err
+	}
+	return sURL, c.client.Del(ctx, redisCacheKey(id)).Err()
+}
+
+func (c *redisCache) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	ids, err := c.Storage.RenameTag(ctx, userID, from, to)
+	if err != nil || len(ids) == 0 {
+		return ids, err
+	}
+	keys := make([]string, len(ids))
+	for index, id := range ids {
+		keys[index] = redisCacheKey(id)
+	}
+	return ids, c.client.Del(ctx, keys...).Err()
+}
+
+func (c *redisCache) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	if err := c.Storage.AddClicks(ctx, clicks); err != nil || len(clicks) == 0 {
+		return err
+	}
+	keys := make([]string, 0, len(clicks))
+	for id := range clicks {
+		keys = append(keys, redisCacheKey(id))
+	}
+	return c.client.Del(ctx, keys...).Err()
+}
+
+func (c *redisCache) Delete(ctx context.Context, id string) error {
+	if err := c.Storage.Delete(ctx, id); err != nil {
+		return err
+	}
+	return c.client.Del(ctx, redisCacheKey(id)).Err()
+}
+
+func (c *redisCache) Unwrap() Storage {
+	return c.Storage
+}
+
+func (c *redisCache) Close() error {
+	if closer, ok := c.Storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return c.client.Close()
+}
+
+// redisFields keeps tags as a comma-separated list, as tags cannot hold commas.
+func redisFields(url ShortURL) map[string]interface{} {
+	return map[string]interface{}{
+		"url":     url.OriginURL,
+		"user":    url.UserID,
+		"created": url.CreatedAt.UnixNano(),
+		"tags":    strings.Join(url.Tags, ","),
+		"folder":  url.Folder,
+		"clicks":  url.Clicks,
+		"preview": url.Preview,
+		"title":   url.Title,
+	}
+}
+
+func redisLink(id string, fields map[string]string) (ShortURL, error) {
+	url := ShortURL{ID: id, OriginURL: fields["url"]}
+	if user, ok := fields["user"]; ok {
+		userID, err := strconv.ParseUint(user, 10, 32)
+		if err != nil {
+			return url, err
+		}
+		url.UserID = uint32(userID)
+	}
+	if created, ok := fields["created"]; ok {
+		nanos, err := strconv.ParseInt(created, 10, 64)
+		if err != nil {
+			return url, err
+		}
+		url.CreatedAt = time.Unix(0, nanos)
+	}
+	if tags := fields["tags"]; tags != "" {
+		url.Tags = strings.Split(tags, ",")
+	}
+	url.Folder = fields["folder"]
+	if clicks, ok := fields["clicks"]; ok {
+		n, err := strconv.ParseInt(clicks, 10, 64)
+		if err != nil {
+			return url, err
+		}
+		url.Clicks = n
+	}
+	url.Preview = fields["preview"] == "1"
+	url.Title = fields["title"]
+	return url, nil
+}
+
+func redisLinkKey(id string) string {
+	return "shortener:link:" + id
+}
+
+func redisUserKey(userID uint32) string {
+	return "shortener:user:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+func redisOriginalKey(url string) string {
+	return "shortener:original:" + lookupKey(url)
+}
+
+func redisHistoryKey(id string) string {
+	return "shortener:history:" + id
+}
+
+func redisCacheKey(id string) string {
+	return "shortener:cache:" + id
+}
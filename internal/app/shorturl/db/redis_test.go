@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	return mr, redis.NewClient(&redis.Options{Addr: mr.Addr()})
+}
+
+func TestRedisStorage(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	st := NewRedisStorage(client)
+	defer st.Close()
+
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	batch, err := st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org"}}, 1)
+	require.NoError(t, err)
+
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, ShortURL{ID: id, OriginURL: "https://example.com", UserID: 1, CreatedAt: url.CreatedAt}, url)
+
+	found, err := st.GetByOriginalURL(ctx, "https://example.org")
+	require.NoError(t, err)
+	assert.Equal(t, batch[0].ID, found)
+
+	url.Preview = true
+	require.NoError(t, st.Save(ctx, url))
+	url, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, url.Preview)
+
+	moved := ShortURL{ID: batch[0].ID, OriginURL: "https://example.net", UserID: 2}
+	require.NoError(t, st.Save(ctx, moved))
+	_, err = st.GetByOriginalURL(ctx, "https://example.org")
+	assert.ErrorIs(t, err, ErrNotFound)
+	urls, err := st.GetURLsByUserID(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, urls, 1)
+	moved.OriginURL, moved.UserID = "https://example.org", 1
+	require.NoError(t, st.Save(ctx, moved))
+
+	urls, err = st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+
+	require.NoError(t, st.Delete(ctx, id))
+	_, err = st.GetByID(ctx, id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = st.GetByOriginalURL(ctx, "https://example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	count := 0
+	require.NoError(t, st.Iterate(ctx, func(url ShortURL) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 1, count)
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	backend := NewMemoryStorage()
+	st := NewRedisCache(client, backend, time.Minute)
+
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	_, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, mr.Exists(redisCacheKey(id)))
+
+	require.NoError(t, backend.Delete(ctx, id))
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", url.OriginURL)
+
+	require.NoError(t, st.Save(ctx, ShortURL{ID: id, OriginURL: "https://example.org", UserID: 1}))
+	assert.False(t, mr.Exists(redisCacheKey(id)))
+	url, err = st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.org", url.OriginURL)
+}
+
+func TestRedisStorage_RetriesAbortedTransactions(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	st := NewRedisStorage(client)
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+
+	attempts := 0
+	write := func(conflicts int) func(tx *redis.Tx) error {
+		return func(tx *redis.Tx) error {
+			attempts++
+			if _, err := redisTxLink(ctx, tx, id); err != nil {
+				return err
+			}
+			if attempts <= conflicts {
+				require.NoError(t, client.HSet(ctx, redisLinkKey(id), "folder", "concurrent").Err())
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, redisLinkKey(id), "folder", "mine")
+				return nil
+			})
+			return err
+		}
+	}
+
+	require.NoError(t, st.watch(ctx, write(1), redisLinkKey(id)))
+	assert.Equal(t, 2, attempts)
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "mine", url.Folder)
+
+	attempts = 0
+	err = st.watch(ctx, write(redisTxRetries), redisLinkKey(id))
+	assert.ErrorIs(t, err, redis.TxFailedErr)
+	assert.Equal(t, redisTxRetries, attempts)
+}
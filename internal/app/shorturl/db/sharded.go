@@ -0,0 +1,405 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sort"
+	"sync"
+)
+
+const virtualNodes = 128
+
+type Shard struct {
+	Name    string
+	Storage Storage
+}
+
+type ringNode struct {
+	hash  uint32
+	shard int
+}
+
+type ShardedStorage struct {
+	shards []Shard
+	ring   []ringNode
+	idGen  IDGenerator
+}
+
+func NewShardedStorage(shards ...Shard) *ShardedStorage {
+	s := &ShardedStorage{shards: shards, idGen: defaultIDGenerator()}
+	for index, shard := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			s.ring = append(s.ring, ringNode{
+				hash:  crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", shard.Name, i))),
+				shard: index,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i].hash < s.ring[j].hash
+	})
+	return s
+}
+
+func (s *ShardedStorage) shardIndex(id string) int {
+	h := crc32.ChecksumIEEE([]byte(id))
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+func (s *ShardedStorage) shardFor(id string) Storage {
+	return s.shards[s.shardIndex(id)].Storage
+}
+
+// Add checks every shard for the URL first, as each shard's unique index
+// only covers its own links. Two concurrent adds of the same URL can still
+// both pass the check.
+func (s *ShardedStorage) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	if err := s.checkFree(ctx, url); err != nil {
+		return "", err
+	}
+	id, err := s.generateID(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	if err := s.shardFor(id).Save(ctx, ShortURL{ID: id, OriginURL: url, UserID: userID}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// AddBatchURL adds all of urls or none, like a batch in one database: it
+// fails with ErrConflict if a URL is already shortened or repeats in the
+// batch, and deletes the links it saved when a later one fails.
+func (s *ShardedStorage) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	seen := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		if seen[url.OriginURL] {
+			return nil, ErrConflict
+		}
+		seen[url.OriginURL] = true
+		if err := s.checkFree(ctx, url.OriginURL); err != nil {
+			return nil, err
+		}
+	}
+
+	for index, url := range urls {
+		id, err := s.generateID(ctx, url.OriginURL)
+		if err == nil {
+			err = s.shardFor(id).Save(ctx, ShortURL{ID: id, OriginURL: url.OriginURL, UserID: userID, Tags: url.Tags, Folder: url.Folder})
+		}
+		if err != nil {
+			for _, saved := range urls[:index] {
+				if err := s.shardFor(saved.ID).Delete(ctx, saved.ID); err != nil && !errors.Is(err, ErrNotFound) {
+					log.Printf("undo batch link %s: %v", saved.ID, err)
+				}
+			}
+			return nil, err
+		}
+		urls[index].ID = id
+	}
+	return urls, nil
+}
+
+func (s *ShardedStorage) checkFree(ctx context.Context, url string) error {
+	_, err := s.GetByOriginalURL(ctx, url)
+	if err == nil {
+		return ErrConflict
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *ShardedStorage) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	return s.shardFor(id).GetByID(ctx, id)
+}
+
+func (s *ShardedStorage) Save(ctx context.Context, url ShortURL) error {
+	return s.shardFor(url.ID).Save(ctx, url)
+}
+
+// Insert checks every shard for the URL first, like Add.
+func (s *ShardedStorage) Insert(ctx context.Context, url ShortURL) error {
+	if err := s.checkFree(ctx, url.OriginURL); err != nil {
+		return err
+	}
+	return s.shardFor(url.ID).Insert(ctx, url)
+}
+
+func (s *ShardedStorage) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	return s.shardFor(id).UpdateURL(ctx, id, url, editorID)
+}
+
+func (s *ShardedStorage) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	return s.shardFor(id).GetHistory(ctx, id)
+}
+
+func (s *ShardedStorage) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	return s.shardFor(id).SetHistory(ctx, id, revs)
+}
+
+func (s *ShardedStorage) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	return s.shardFor(id).SetPreview(ctx, id, preview)
+}
+
+func (s *ShardedStorage) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	return s.shardFor(id).SetTitle(ctx, id, title)
+}
+
+func (s *ShardedStorage) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	return s.shardFor(id).SetLabels(ctx, id, tags, folder)
+}
+
+func (s *ShardedStorage) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	results := make([][]TagCount, len(s.shards))
+	err := s.scatter(func(index int, st Storage) error {
+		tags, err := st.ListTags(ctx, userID)
+		results[index] = tags
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, tags := range results {
+		for _, tag := range tags {
+			counts[tag.Tag] += tag.Count
+		}
+	}
+	return tagCounts(counts), nil
+}
+
+func (s *ShardedStorage) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	results := make([][]string, len(s.shards))
+	err := s.scatter(func(index int, st Storage) error {
+		ids, err := st.RenameTag(ctx, userID, from, to)
+		results[index] = ids
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result...)
+	}
+	return ids, nil
+}
+
+func (s *ShardedStorage) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	byShard := make([]map[string]int64, len(s.shards))
+	for id, n := range clicks {
+		index := s.shardIndex(id)
+		if byShard[index] == nil {
+			byShard[index] = make(map[string]int64)
+		}
+		byShard[index][id] = n
+	}
+	return s.scatter(func(index int, st Storage) error {
+		if byShard[index] == nil {
+			return nil
+		}
+		return st.AddClicks(ctx, byShard[index])
+	})
+}
+
+func (s *ShardedStorage) Delete(ctx context.Context, id string) error {
+	return s.shardFor(id).Delete(ctx, id)
+}
+
+func (s *ShardedStorage) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	ids := make([]string, len(s.shards))
+	err := s.scatter(func(index int, st Storage) error {
+		id, err := st.GetByOriginalURL(ctx, url)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		ids[index] = id
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		if id != "" {
+			return id, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (s *ShardedStorage) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	results := make([][]ShortURL, len(s.shards))
+	err := s.scatter(func(index int, st Storage) error {
+		urls, err := st.GetURLsByUserID(ctx, userID)
+		results[index] = urls
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var urls []ShortURL
+	for _, result := range results {
+		urls = append(urls, result...)
+	}
+	return urls, nil
+}
+
+func (s *ShardedStorage) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	urls, err := s.GetURLsByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return iterateOldestFirst(ctx, urls, fn)
+}
+
+// ListURLs runs q on every shard and merges the pages. The cursor holds
+// the sort key of the last link, so it applies to each shard as is.
+func (s *ShardedStorage) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	if _, err := q.normalize(); err != nil {
+		return URLPage{}, err
+	}
+	results := make([]URLPage, len(s.shards))
+	err := s.scatter(func(index int, st Storage) error {
+		page, err := st.ListURLs(ctx, q)
+		results[index] = page
+		return err
+	})
+	if err != nil {
+		return URLPage{}, err
+	}
+
+	var urls []ShortURL
+	more := false
+	for _, result := range results {
+		urls = append(urls, result.URLs...)
+		more = more || result.NextCursor != ""
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return q.less(urls[i], urls[j])
+	})
+	page := q.page(urls, nil)
+	if more && page.NextCursor == "" && len(page.URLs) > 0 {
+		page.NextCursor = q.cursorAfter(page.URLs[len(page.URLs)-1])
+	}
+	return page, nil
+}
+
+func (s *ShardedStorage) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	for _, shard := range s.shards {
+		if err := shard.Storage.Iterate(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebalance moves every link that is stored on a shard other than the one
+// the ring assigns it to. It is meant to be run after shards are added.
+func (s *ShardedStorage) Rebalance(ctx context.Context, progress func(shard string, moved int)) (int, error) {
+	total := 0
+	for index, shard := range s.shards {
+		var misplaced []ShortURL
+		err := shard.Storage.Iterate(ctx, func(url ShortURL) error {
+			if s.shardIndex(url.ID) != index {
+				misplaced = append(misplaced, url)
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+
+		for _, url := range misplaced {
+			if err := s.move(ctx, shard.Storage, url); err != nil {
+				return total, err
+			}
+			total++
+		}
+		if progress != nil {
+			progress(shard.Name, len(misplaced))
+		}
+	}
+	return total, nil
+}
+
+// move copies url with its history from the shard it is on to its own
+// shard, then deletes it from the former. A copy left by an interrupted
+// run is kept, and only gets the history if it has none yet.
+func (s *ShardedStorage) move(ctx context.Context, from Storage, url ShortURL) error {
+	revs, err := from.GetHistory(ctx, url.ID)
+	if err != nil {
+		return err
+	}
+	to := s.shardFor(url.ID)
+	current, err := to.GetHistory(ctx, url.ID)
+	if errors.Is(err, ErrNotFound) {
+		err = to.Save(ctx, url)
+	}
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 && len(revs) > 0 {
+		if err := to.SetHistory(ctx, url.ID, revs); err != nil {
+			return err
+		}
+	}
+	return from.Delete(ctx, url.ID)
+}
+
+func (s *ShardedStorage) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if closer, ok := shard.Storage.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (s *ShardedStorage) scatter(fn func(index int, st Storage) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.shards))
+	for index, shard := range s.shards {
+		wg.Add(1)
+		go func(index int, st Storage) {
+			defer wg.Done()
+			errs[index] = fn(index, st)
+		}(index, shard.Storage)
+	}
+	wg.Wait()
+
+	for index, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", s.shards[index].Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStorage) SetIDGenerator(gen IDGenerator) {
+	s.idGen = gen
+}
+
+func (s *ShardedStorage) generateID(ctx context.Context, url string) (string, error) {
+	return newID(s.idGen, url, func(id string) (bool, error) {
+		_, err := s.shardFor(id).GetByID(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			return true, nil
+		}
+		return false, err
+	})
+}
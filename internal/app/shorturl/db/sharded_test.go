@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestShardedStorage_Rebalance(t *testing.T) {
+	ctx := context.Background()
+	first, second, third := NewMemoryStorage(), NewMemoryStorage(), NewMemoryStorage()
+
+	st := NewShardedStorage(Shard{Name: "first", Storage: first}, Shard{Name: "second", Storage: second})
+	ids := make([]string, 100)
+	for i := range ids {
+		id, err := st.Add(ctx, fmt.Sprintf("https://example.com/%d", i), uint32(i%3))
+		require.NoError(t, err)
+		ids[i] = id
+	}
+
+	urls, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 33)
+
+	id, err := st.GetByOriginalURL(ctx, "https://example.com/42")
+	require.NoError(t, err)
+	assert.Equal(t, ids[42], id)
+	for _, id := range ids {
+		_, err := st.UpdateURL(ctx, id, "https://example.com/edited/"+id, 1)
+		require.NoError(t, err)
+		_, err = st.SetTitle(ctx, id, "Title "+id)
+		require.NoError(t, err)
+	}
+
+	grown := NewShardedStorage(
+		Shard{Name: "first", Storage: first},
+		Shard{Name: "second", Storage: second},
+		Shard{Name: "third", Storage: third},
+	)
+	moved, err := grown.Rebalance(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, len(third.urls), moved)
+	assert.Equal(t, 100, len(first.urls)+len(second.urls)+len(third.urls))
+
+	for i, id := range ids {
+		url, err := grown.GetByID(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/edited/"+id, url.OriginURL)
+		assert.Equal(t, "Title "+id, url.Title)
+		revs, err := grown.GetHistory(ctx, id)
+		require.NoError(t, err)
+		require.Len(t, revs, 1)
+		assert.Equal(t, fmt.Sprintf("https://example.com/%d", i), revs[0].OriginURL)
+	}
+}
+
+type failingSaves struct {
+	Storage
+}
+
+func (f failingSaves) Save(ctx context.Context, url ShortURL) error {
+	return errors.New("shard down")
+}
+
+func TestShardedStorage_Dedup(t *testing.T) {
+	ctx := context.Background()
+	first, second := NewMemoryStorage(), NewMemoryStorage()
+	st := NewShardedStorage(Shard{Name: "first", Storage: first}, Shard{Name: "second", Storage: second})
+
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = st.Add(ctx, "https://example.com", 2)
+		assert.ErrorIs(t, err, ErrConflict)
+	}
+	assert.Equal(t, 1, len(first.urls)+len(second.urls))
+
+	_, err = st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org"}, {OriginURL: "https://example.com"}}, 1)
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org"}, {OriginURL: "https://example.org"}}, 1)
+	assert.ErrorIs(t, err, ErrConflict)
+	found, err := st.GetByOriginalURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id, found)
+	_, err = st.GetByOriginalURL(ctx, "https://example.org")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestShardedStorage_AddBatchURLUndo(t *testing.T) {
+	ctx := context.Background()
+	healthy := NewMemoryStorage()
+	st := NewShardedStorage(Shard{Name: "healthy", Storage: healthy}, Shard{Name: "down", Storage: failingSaves{NewMemoryStorage()}})
+
+	urls := make([]ShortURL, 20)
+	for i := range urls {
+		urls[i].OriginURL = fmt.Sprintf("https://example.com/%d", i)
+	}
+	_, err := st.AddBatchURL(ctx, urls, 1)
+	require.Error(t, err)
+	assert.Empty(t, healthy.urls)
+}
@@ -0,0 +1,727 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
+	"log"
+	"strings"
+	"time"
+)
+
+const sqlPageSize = 1000
+
+const insertURL = "INSERT INTO urls (shorturl, originurl, userid, url_index) VALUES($1, $2, $3, $4) ON CONFLICT (shorturl) DO NOTHING"
+
+type dbSQL struct {
+	db      *sql.DB
+	dialect dialect
+	idGen   IDGenerator
+}
+
+func NewPostgresStorage(db *sql.DB) *dbSQL {
+	return &dbSQL{db: db, dialect: postgresDialect{}, idGen: defaultIDGenerator()}
+}
+
+func NewSQLiteStorage(db *sql.DB) *dbSQL {
+	return &dbSQL{db: db, dialect: sqliteDialect{}, idGen: defaultIDGenerator()}
+}
+
+func (p *dbSQL) SetIDGenerator(gen IDGenerator) {
+	p.idGen = gen
+}
+
+func (p *dbSQL) AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error) {
+	tx, err := p.db.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, insertURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stmt.Close()
+
+	for index, url := range urls {
+		id, err := p.insert(ctx, stmt, url.OriginURL, userID)
+		if err != nil {
+			return nil, err
+		}
+		urls[index].ID = id
+		if url.Tags == nil && url.Folder == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE urls SET folder = $1 WHERE shorturl = $2", url.Folder, id); err != nil {
+			return nil, err
+		}
+		if err := p.writeTags(ctx, tx, ShortURL{ID: id, UserID: userID, Tags: url.Tags}); err != nil {
+			return nil, err
+		}
+	}
+	for _, url := range urls {
+		if err := p.notify(ctx, tx, url.ID); err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func (p *dbSQL) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	stmt, err := p.db.PrepareContext(ctx, insertURL)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	id, err := p.insert(ctx, stmt, url, userID)
+	if err != nil {
+		return "", err
+	}
+	if err := p.notify(ctx, p.db, id); err != nil {
+		log.Println(err)
+	}
+	return id, nil
+}
+
+// GetByOriginalURL looks sealed URLs up by the url_index column, as their
+// ciphertext differs on every write.
+func (p *dbSQL) GetByOriginalURL(ctx context.Context, url string) (string, error) {
+	query := "SELECT shorturl FROM urls WHERE originurl = $1"
+	if blindIndex(url) != "" {
+		query = "SELECT shorturl FROM urls WHERE url_index = $1"
+	}
+	row := p.db.QueryRowContext(ctx, query, lookupKey(url))
+	var result string
+	if err := row.Scan(&result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return result, nil
+}
+
+func (p *dbSQL) GetByURLAndUserID(ctx context.Context, url string, userID uint32) (ShortURL, error) {
+	row := p.db.QueryRowContext(ctx, "SELECT shorturl, originurl, userid, created_on, folder, clicks, preview, title FROM urls WHERE originurl = $1 AND userid = $2", url, userID)
+	var result ShortURL
+	if err := row.Scan(&result.ID, &result.OriginURL, &result.UserID, &result.CreatedAt, &result.Folder, &result.Clicks, &result.Preview, &result.Title); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return result, ErrNotFound
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+func (p *dbSQL) GetByID(ctx context.Context, id string) (ShortURL, error) {
+	row := p.db.QueryRowContext(ctx, "SELECT shorturl, originurl, userid, created_on, folder, clicks, preview, title FROM urls WHERE shorturl = $1", id)
+	var result ShortURL
+	if err := row.Scan(&result.ID, &result.OriginURL, &result.UserID, &result.CreatedAt, &result.Folder, &result.Clicks, &result.Preview, &result.Title); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return result, ErrNotFound
+		}
+		return result, err
+	}
+	tags, err := p.tags(ctx, p.db, id)
+	result.Tags = tags
+	return result, err
+}
+
+// Save replaces the row of a link that already has the ID, like the other
+// storages do, so restores and re-encryption can rewrite links in place.
+func (p *dbSQL) Save(ctx context.Context, url ShortURL) error {
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	return p.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO urls (shorturl, originurl, userid, created_on, folder, clicks, preview, url_index, title) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (shorturl) DO UPDATE SET originurl = excluded.originurl, userid = excluded.userid, created_on = excluded.created_on,
+			folder = excluded.folder, clicks = excluded.clicks, preview = excluded.preview, url_index = excluded.url_index, title = excluded.title`,
+			url.ID, url.OriginURL, url.UserID, p.dialect.timeValue(url.CreatedAt), url.Folder, url.Clicks, url.Preview, indexValue(url.OriginURL), url.Title)
+		if err != nil {
+			return p.mapError(err)
+		}
+		if err := p.writeTags(ctx, tx, url); err != nil {
+			return err
+		}
+		return p.notify(ctx, tx, url.ID)
+	})
+}
+
+// Insert skips a taken ID with ON CONFLICT, so it can tell ErrIDTaken from
+// a URL conflict, which still fails on the unique index.
+func (p *dbSQL) Insert(ctx context.Context, url ShortURL) error {
+	if url.CreatedAt.IsZero() {
+		url.CreatedAt = time.Now()
+	}
+	return p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT INTO urls (shorturl, originurl, userid, created_on, folder, clicks, preview, url_index, title) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (shorturl) DO NOTHING`,
+			url.ID, url.OriginURL, url.UserID, p.dialect.timeValue(url.CreatedAt), url.Folder, url.Clicks, url.Preview, indexValue(url.OriginURL), url.Title)
+		if err != nil {
+			return p.mapError(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrIDTaken
+		}
+		if err := p.writeTags(ctx, tx, url); err != nil {
+			return err
+		}
+		return p.notify(ctx, tx, url.ID)
+	})
+}
+
+func (p *dbSQL) Delete(ctx context.Context, id string) error {
+	return p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM urls WHERE shorturl = $1", id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM url_history WHERE shorturl = $1", id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM url_tags WHERE shorturl = $1", id); err != nil {
+			return err
+		}
+		return p.notify(ctx, tx, id)
+	})
+}
+
+func (p *dbSQL) UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error) {
+	var sURL ShortURL
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, "SELECT shorturl, originurl, userid, created_on, folder, clicks, preview, title FROM urls WHERE shorturl = $1"+p.dialect.forUpdate(), id)
+		if err := row.Scan(&sURL.ID, &sURL.OriginURL, &sURL.UserID, &sURL.CreatedAt, &sURL.Folder, &sURL.Clicks, &sURL.Preview, &sURL.Title); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		var versions int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM url_history WHERE shorturl = $1", id).Scan(&versions); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO url_history (shorturl, version, originurl, editorid, edited_on) VALUES($1, $2, $3, $4, $5)",
+			id, versions+1, sURL.OriginURL, editorID, p.dialect.timeValue(time.Now()))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE urls SET originurl = $1, url_index = $2 WHERE shorturl = $3", url, indexValue(url), id); err != nil {
+			return p.mapError(err)
+		}
+		sURL.OriginURL = url
+		if sURL.Tags, err = p.tags(ctx, tx, id); err != nil {
+			return err
+		}
+		return p.notify(ctx, tx, id)
+	})
+	return sURL, err
+}
+
+func (p *dbSQL) SetHistory(ctx context.Context, id string, revs []Revision) error {
+	return p.withTx(ctx, func(tx *sql.Tx) error {
+		var found string
+		if err := tx.QueryRowContext(ctx, "SELECT shorturl FROM urls WHERE shorturl = $1"+p.dialect.forUpdate(), id).Scan(&found); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM url_history WHERE shorturl = $1", id); err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			_, err := tx.ExecContext(ctx, "INSERT INTO url_history (shorturl, version, originurl, editorid, edited_on) VALUES($1, $2, $3, $4, $5)",
+				id, rev.Version, rev.OriginURL, rev.EditorID, p.dialect.timeValue(rev.EditedAt))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *dbSQL) GetHistory(ctx context.Context, id string) ([]Revision, error) {
+	if _, err := p.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+	rows, err := p.db.QueryContext(ctx, "SELECT version, originurl, editorid, edited_on FROM url_history WHERE shorturl = $1 ORDER BY version", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		if err := rows.Scan(&rev.Version, &rev.OriginURL, &rev.EditorID, &rev.EditedAt); err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (p *dbSQL) ListURLs(ctx context.Context, q URLQuery) (URLPage, error) {
+	c, err := q.normalize()
+	if err != nil {
+		return URLPage{}, err
+	}
+
+	args := []interface{}{q.UserID}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := []string{"userid = $1"}
+	if q.Search != "" {
+		where = append(where, fmt.Sprintf(`originurl %s %s ESCAPE '\'`, p.dialect.caseInsensitiveLike(), arg("%"+likeEscaper.Replace(q.Search)+"%")))
+	}
+	created := p.dialect.timestamp("created_on")
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, created+" >= "+arg(p.dialect.timeValue(q.CreatedAfter)))
+	}
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, created+" < "+arg(p.dialect.timeValue(q.CreatedBefore)))
+	}
+
+	sortKey, order, op := created, "ASC", ">"
+	if q.byURL() {
+		sortKey = "originurl"
+	}
+	if q.descending() {
+		order, op = "DESC", "<"
+	}
+	if q.Folder != "" {
+		where = append(where, "folder = "+arg(q.Folder))
+	}
+	for _, tag := range q.Tags {
+		where = append(where, "EXISTS (SELECT 1 FROM url_tags WHERE url_tags.shorturl = urls.shorturl AND url_tags.tag = "+arg(tag)+")")
+	}
+	if c != nil {
+		last := arg(p.dialect.timeValue(c.CreatedAt))
+		if q.byURL() {
+			last = arg(c.OriginURL)
+		}
+		where = append(where, fmt.Sprintf("(%s, shorturl) %s (%s, %s)", sortKey, op, last, arg(c.ID)))
+	}
+
+	query := "SELECT shorturl, originurl, userid, created_on, folder, clicks, preview, title FROM urls WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY " + sortKey + " " + order + ", shorturl " + order
+	if q.Limit > 0 {
+		query += " LIMIT " + arg(q.Limit+1)
+	}
+	urls, err := p.queryURLs(ctx, query, args...)
+	if err != nil {
+		return URLPage{}, err
+	}
+	page := URLPage{URLs: urls}
+	if q.Limit > 0 && len(page.URLs) > q.Limit {
+		page.URLs = page.URLs[:q.Limit]
+		page.NextCursor = q.cursorAfter(page.URLs[q.Limit-1])
+	}
+	return page, nil
+}
+
+// Iterate reads links in pages so fn runs without holding a connection and
+// may write to the same storage.
+func (p *dbSQL) Iterate(ctx context.Context, fn func(url ShortURL) error) error {
+	var after int64
+	for {
+		page, last, err := p.page(ctx, after)
+		if err != nil {
+			return err
+		}
+		for _, url := range page {
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+		if len(page) < sqlPageSize {
+			return nil
+		}
+		after = last
+	}
+}
+
+func (p *dbSQL) page(ctx context.Context, after int64) ([]ShortURL, int64, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT id, shorturl, originurl, userid, created_on, folder, clicks, preview, title FROM urls WHERE id > $1 ORDER BY id LIMIT $2",
+		after, sqlPageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	page := make([]ShortURL, 0, sqlPageSize)
+	for rows.Next() {
+		var url ShortURL
+		if err := rows.Scan(&after, &url.ID, &url.OriginURL, &url.UserID, &url.CreatedAt, &url.Folder, &url.Clicks, &url.Preview, &url.Title); err != nil {
+			return nil, 0, err
+		}
+		page = append(page, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+	return page, after, p.loadTags(ctx, page)
+}
+
+// IterateUser pages through ListURLs, which seeks by the sort key, so no
+// rows are held open while fn runs.
+func (p *dbSQL) IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error {
+	q := URLQuery{UserID: userID, Sort: SortCreatedAsc, Limit: sqlPageSize}
+	for {
+		page, err := p.ListURLs(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, url := range page.URLs {
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func (p *dbSQL) GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error) {
+	return p.queryURLs(ctx, "SELECT shorturl, originurl, userid, created_on, folder, clicks, preview, title FROM urls WHERE userid = $1", userID)
+}
+
+// queryURLs reads links with their tags. The tags are loaded once the rows
+// are closed, as SQLite runs with a single connection.
+func (p *dbSQL) queryURLs(ctx context.Context, query string, args ...interface{}) ([]ShortURL, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ShortURL
+	for rows.Next() {
+		var url ShortURL
+		if err := rows.Scan(&url.ID, &url.OriginURL, &url.UserID, &url.CreatedAt, &url.Folder, &url.Clicks, &url.Preview, &url.Title); err != nil {
+			return nil, err
+		}
+		result = append(result, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return result, p.loadTags(ctx, result)
+}
+
+func (p *dbSQL) SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error) {
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE urls SET preview = $1 WHERE shorturl = $2", preview, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		return p.notify(ctx, tx, id)
+	})
+	if err != nil {
+		return ShortURL{}, err
+	}
+	return p.GetByID(ctx, id)
+}
+
+func (p *dbSQL) SetTitle(ctx context.Context, id, title string) (ShortURL, error) {
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE urls SET title = $1 WHERE shorturl = $2", title, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		return p.notify(ctx, tx, id)
+	})
+	if err != nil {
+		return ShortURL{}, err
+	}
+	return p.GetByID(ctx, id)
+}
+
+func (p *dbSQL) SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error) {
+	var sURL ShortURL
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, "SELECT shorturl, originurl, userid, created_on, clicks, preview, title FROM urls WHERE shorturl = $1"+p.dialect.forUpdate(), id)
+		if err := row.Scan(&sURL.ID, &sURL.OriginURL, &sURL.UserID, &sURL.CreatedAt, &sURL.Clicks, &sURL.Preview, &sURL.Title); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		sURL.Tags, sURL.Folder = tags, folder
+		if _, err := tx.ExecContext(ctx, "UPDATE urls SET folder = $1 WHERE shorturl = $2", folder, id); err != nil {
+			return err
+		}
+		if err := p.writeTags(ctx, tx, sURL); err != nil {
+			return err
+		}
+		return p.notify(ctx, tx, id)
+	})
+	return sURL, err
+}
+
+func (p *dbSQL) ListTags(ctx context.Context, userID uint32) ([]TagCount, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT tag, COUNT(*) FROM url_tags WHERE userid = $1 GROUP BY tag ORDER BY tag", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// RenameTag moves the user's links from one tag to another. Links that
+// already carry the new tag keep a single copy of it.
+func (p *dbSQL) RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error) {
+	var ids []string
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT shorturl FROM url_tags WHERE userid = $1 AND tag = $2"+p.dialect.forUpdate(), userID, from)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM url_tags WHERE userid = $1 AND tag = $2", userID, from); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, err := tx.ExecContext(ctx, "INSERT INTO url_tags (shorturl, userid, tag) VALUES($1, $2, $3) ON CONFLICT (shorturl, tag) DO NOTHING", id, userID, to)
+			if err != nil {
+				return err
+			}
+			if err := p.notify(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// AddClicks does not notify other instances, so cached copies show older
+// counts until they expire; evicting hot links on every flush would defeat
+// the cache.
+func (p *dbSQL) AddClicks(ctx context.Context, clicks map[string]int64) error {
+	return p.withTx(ctx, func(tx *sql.Tx) error {
+		for id, n := range clicks {
+			if _, err := tx.ExecContext(ctx, "UPDATE urls SET clicks = clicks + $1 WHERE shorturl = $2", n, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (p *dbSQL) tags(ctx context.Context, q querier, id string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT tag FROM url_tags WHERE shorturl = $1 ORDER BY tag", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// loadTags fills in the tags of urls with a single query.
+func (p *dbSQL) loadTags(ctx context.Context, urls []ShortURL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	index := make(map[string]int, len(urls))
+	args := make([]interface{}, len(urls))
+	params := make([]string, len(urls))
+	for i, url := range urls {
+		index[url.ID] = i
+		args[i] = url.ID
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	rows, err := p.db.QueryContext(ctx, "SELECT shorturl, tag FROM url_tags WHERE shorturl IN ("+strings.Join(params, ", ")+") ORDER BY tag", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		i := index[id]
+		urls[i].Tags = append(urls[i].Tags, tag)
+	}
+	return rows.Err()
+}
+
+func (p *dbSQL) writeTags(ctx context.Context, tx *sql.Tx, url ShortURL) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM url_tags WHERE shorturl = $1", url.ID); err != nil {
+		return err
+	}
+	for _, tag := range url.Tags {
+		_, err := tx.ExecContext(ctx, "INSERT INTO url_tags (shorturl, userid, tag) VALUES($1, $2, $3)", url.ID, url.UserID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *dbSQL) MigrateUp(sourceURL string) error {
+	driver, err := p.dialect.migrationDriver(p.db)
+
+	if err != nil {
+		return err
+	}
+
+	src, err := source.Open(sourceURL)
+
+	if err != nil {
+		return err
+	}
+
+	m, err := migrate.NewWithInstance(
+		"migrations", &rewritingSource{Driver: src, rewrite: p.dialect.rewriteMigration},
+		p.dialect.name(), driver)
+
+	if err != nil {
+		return err
+	}
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return err
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// notify publishes a link change so other instances evict it from their caches.
+func (p *dbSQL) notify(ctx context.Context, ex execer, id string) error {
+	if !p.dialect.supportsNotify() {
+		return nil
+	}
+	_, err := ex.ExecContext(ctx, "SELECT pg_notify($1, $2)", LinksChannel, id)
+	return err
+}
+
+func (p *dbSQL) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// indexValue is the url_index of a stored URL, NULL unless it is sealed.
+func indexValue(url string) interface{} {
+	if index := blindIndex(url); index != "" {
+		return index
+	}
+	return nil
+}
+
+func (p *dbSQL) mapError(err error) error {
+	if err != nil && p.dialect.isURLConflict(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// insert retries with a new ID while the generated one is taken. Taken IDs
+// are skipped with ON CONFLICT so a collision does not abort the transaction.
+func (p *dbSQL) insert(ctx context.Context, stmt *sql.Stmt, url string, userID uint32) (string, error) {
+	return newID(p.idGen, url, func(id string) (bool, error) {
+		res, err := stmt.ExecContext(ctx, id, url, userID, indexValue(url))
+		if err != nil {
+			return false, p.mapError(err)
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	})
+}
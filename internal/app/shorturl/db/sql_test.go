@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLite(t *testing.T) *dbSQL {
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "urls.db"))
+	require.NoError(t, err)
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+
+	st := NewSQLiteStorage(conn)
+	require.NoError(t, st.MigrateUp("file://../../../../migrations"))
+	return st
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	ctx := context.Background()
+	st := newTestSQLite(t)
+
+	id, err := st.Add(ctx, "https://example.com", 1)
+	require.NoError(t, err)
+
+	_, err = st.Add(ctx, "https://example.com", 2)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	_, err = st.AddBatchURL(ctx, []ShortURL{{OriginURL: "https://example.org"}, {OriginURL: "https://example.com"}}, 2)
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = st.GetByOriginalURL(ctx, "https://example.org")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	url, err := st.GetByID(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", url.OriginURL)
+	assert.False(t, url.CreatedAt.IsZero())
+
+	found, err := st.GetByOriginalURL(ctx, "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id, found)
+
+	require.NoError(t, st.Save(ctx, ShortURL{ID: "custom", OriginURL: "https://example.net", UserID: 1, Preview: true}))
+	urls, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+	url, err = st.GetByID(ctx, "custom")
+	require.NoError(t, err)
+	assert.True(t, url.Preview)
+
+	require.NoError(t, st.Delete(ctx, id))
+	assert.ErrorIs(t, st.Delete(ctx, id), ErrNotFound)
+
+	var ids []string
+	require.NoError(t, st.Iterate(ctx, func(url ShortURL) error {
+		ids = append(ids, url.ID)
+		return nil
+	}))
+	assert.Equal(t, []string{"custom"}, ids)
+}
@@ -2,6 +2,13 @@ package db
 
 import (
 	"context"
+	"errors"
+)
+
+var (
+	ErrNotFound = errors.New("short url not found")
+	ErrConflict = errors.New("original url already shortened")
+	ErrIDTaken  = errors.New("short url id already taken")
 )
 
 type Storage interface {
@@ -10,4 +17,41 @@ type Storage interface {
 	GetByOriginalURL(ctx context.Context, url string) (string, error)
 	GetURLsByUserID(ctx context.Context, userID uint32) ([]ShortURL, error)
 	AddBatchURL(ctx context.Context, urls []ShortURL, userID uint32) ([]ShortURL, error)
+	// Save stores url under its ID as given, replacing any link with that ID.
+	Save(ctx context.Context, url ShortURL) error
+	// Insert stores url under its ID only if the ID is free (else ErrIDTaken)
+	// and the URL is not shortened yet (else ErrConflict).
+	Insert(ctx context.Context, url ShortURL) error
+	Delete(ctx context.Context, id string) error
+	Iterate(ctx context.Context, fn func(url ShortURL) error) error
+	// IterateUser calls fn for every link of the user, oldest first.
+	IterateUser(ctx context.Context, userID uint32, fn func(url ShortURL) error) error
+	UpdateURL(ctx context.Context, id, url string, editorID uint32) (ShortURL, error)
+	GetHistory(ctx context.Context, id string) ([]Revision, error)
+	// SetHistory replaces the revisions of link id, for restores and moves.
+	SetHistory(ctx context.Context, id string, revs []Revision) error
+	ListURLs(ctx context.Context, q URLQuery) (URLPage, error)
+	SetLabels(ctx context.Context, id string, tags []string, folder string) (ShortURL, error)
+	SetPreview(ctx context.Context, id string, preview bool) (ShortURL, error)
+	SetTitle(ctx context.Context, id, title string) (ShortURL, error)
+	ListTags(ctx context.Context, userID uint32) ([]TagCount, error)
+	RenameTag(ctx context.Context, userID uint32, from, to string) ([]string, error)
+	AddClicks(ctx context.Context, clicks map[string]int64) error
+}
+
+type decorator interface {
+	Unwrap() Storage
+}
+
+// Layers lists st and every storage it decorates, outermost first.
+func Layers(st Storage) []Storage {
+	layers := []Storage{st}
+	for {
+		d, ok := st.(decorator)
+		if !ok {
+			return layers
+		}
+		st = d.Unwrap()
+		layers = append(layers, st)
+	}
 }
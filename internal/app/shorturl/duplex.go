@@ -0,0 +1,11 @@
+//go:build go1.21
+
+package shorturl
+
+import "net/http"
+
+// enableFullDuplex keeps the request body readable after the response has
+// started, which HTTP/1 servers otherwise drain or close on the first write.
+func enableFullDuplex(w http.ResponseWriter) error {
+	return http.NewResponseController(w).EnableFullDuplex()
+}
@@ -0,0 +1,14 @@
+//go:build !go1.21
+
+package shorturl
+
+import (
+	"errors"
+	"net/http"
+)
+
+// enableFullDuplex needs Go 1.21; before it only HTTP/2 requests can be read
+// while the response is written.
+func enableFullDuplex(w http.ResponseWriter) error {
+	return errors.New("full duplex needs go1.21")
+}
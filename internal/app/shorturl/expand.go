@@ -0,0 +1,170 @@
+package shorturl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Expand returns the destinations of a JSON array of short IDs or short
+// URLs of this service without redirecting or counting clicks. Each input
+// gets an entry, with an error when it is not a known link.
+func (h *handler) Expand(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var inputs []string
+	err := h.decodeBatch(w, r, func(dec *json.Decoder) error {
+		var input string
+		if err := dec.Decode(&input); err != nil {
+			return err
+		}
+		inputs = append(inputs, input)
+		return nil
+	})
+	if errors.Is(err, errBatchTooLarge) {
+		http.Error(w, fmt.Sprintf("expand is limited to %d urls", h.maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	respUrls := make([]RespExpandURL, len(inputs))
+	for index, input := range inputs {
+		respUrls[index].Input = input
+		id, ok := h.shortID(input)
+		if !ok {
+			respUrls[index].Error = "not a short url of this service"
+			continue
+		}
+		shortURL, err := h.shortURLService.GetByID(ctx, id)
+		if errors.Is(err, db.ErrNotFound) {
+			respUrls[index].Error = "not found"
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		info := h.linkInfo(shortURL, userID)
+		respUrls[index].RespLinkInfo = &info
+	}
+
+	resp, err := json.Marshal(respUrls)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+// Lookup returns the short URLs of a destination: the one shortening it
+// again would return, and any other links of the user to it.
+func (h *handler) Lookup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	originURL := r.URL.Query().Get("url")
+	if _, err := url.ParseRequestURI(originURL); err != nil {
+		http.Error(w, "url is invalid", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var ids []string
+	id, err := h.shortURLService.GetByOriginalURL(ctx, originURL)
+	if err == nil {
+		ids = append(ids, id)
+	} else if !errors.Is(err, db.ErrNotFound) {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	page, err := h.shortURLService.ListURLs(ctx, db.URLQuery{UserID: userID, Search: originURL, Sort: db.SortCreatedAsc})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	for _, shortURL := range page.URLs {
+		if shortURL.OriginURL == originURL && shortURL.ID != id {
+			ids = append(ids, shortURL.ID)
+		}
+	}
+	if len(ids) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	respLookup := RespLookup{OriginalURL: originURL, ShortURLs: make([]string, len(ids))}
+	for index, id := range ids {
+		respLookup.ShortURLs[index] = fmt.Sprintf("%s/%s", h.baseURL, id)
+	}
+	resp, err := json.Marshal(respLookup)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+// shortID takes the ID from a short URL on the host of baseURL, with or
+// without a scheme, or returns a bare ID as is.
+func (h *handler) shortID(input string) (string, bool) {
+	input = strings.TrimSpace(input)
+	if !strings.Contains(input, "/") {
+		return input, input != ""
+	}
+	if !strings.Contains(input, "://") {
+		input = "//" + input
+	}
+	link, err := url.Parse(input)
+	if err != nil {
+		return "", false
+	}
+	base, err := url.Parse(h.baseURL)
+	if err != nil || !strings.EqualFold(link.Host, base.Host) {
+		return "", false
+	}
+	id := strings.TrimPrefix(link.Path, strings.TrimSuffix(base.Path, "/")+"/")
+	return id, id != "" && !strings.Contains(id, "/")
+}
+
+// linkInfo describes a link to anyone; its labels and clicks only to the
+// owner.
+func (h *handler) linkInfo(shortURL db.ShortURL, userID uint32) RespLinkInfo {
+	info := RespLinkInfo{
+		ShortURL:    fmt.Sprintf("%s/%s", h.baseURL, shortURL.ID),
+		OriginalURL: shortURL.OriginURL,
+		CreatedAt:   shortURL.CreatedAt,
+	}
+	if shortURL.UserID == userID {
+		info.Tags, info.Folder, info.Clicks = shortURL.Tags, shortURL.Folder, &shortURL.Clicks
+	}
+	return info
+}
@@ -0,0 +1,170 @@
+package shorturl
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is how many links are written between flushes, so rows
+// reach the client while the export runs.
+const exportFlushEvery = 100
+
+type exportWriter interface {
+	Write(url RespShortURL) error
+	Flush() error
+	Close() error
+}
+
+var exportFormats = map[string]struct {
+	contentType string
+	open        func(w io.Writer) (exportWriter, error)
+}{
+	"csv":    {"text/csv; charset=utf-8", newCSVExport},
+	"ndjson": {"application/x-ndjson", newNDJSONExport},
+	"json":   {"application/json; charset=utf-8", newJSONExport},
+}
+
+// ExportURLs streams every link of the user as csv, ndjson or a json array,
+// chosen by the format parameter (csv by default). An error after the first
+// row can only cut the download short, so it is logged.
+func (h *handler) ExportURLs(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "csv"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		http.Error(w, "format must be csv, ndjson or json", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="links.`+name+`"`)
+	ew, err := format.open(w)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+
+	count := 0
+	err = h.shortURLService.ExportURLs(r.Context(), userID, func(url db.ShortURL) error {
+		if err := ew.Write(h.respShortURL(url)); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushEvery != 0 {
+			return nil
+		}
+		if err := ew.Flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := ew.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) (exportWriter, error) {
+	e := &csvExport{w: csv.NewWriter(w)}
+	return e, e.w.Write([]string{"short_url", "original_url", "created_at", "tags", "folder", "clicks"})
+}
+
+// Write joins tags with commas, which tags cannot contain.
+func (e *csvExport) Write(url RespShortURL) error {
+	return e.w.Write([]string{
+		url.ShortURL,
+		url.OriginalURL,
+		url.CreatedAt.UTC().Format(time.RFC3339),
+		strings.Join(url.Tags, ","),
+		url.Folder,
+		strconv.FormatInt(url.Clicks, 10),
+	})
+}
+
+func (e *csvExport) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) Close() error {
+	return e.Flush()
+}
+
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func newNDJSONExport(w io.Writer) (exportWriter, error) {
+	return &ndjsonExport{enc: json.NewEncoder(w)}, nil
+}
+
+func (e *ndjsonExport) Write(url RespShortURL) error {
+	return e.enc.Encode(url)
+}
+
+func (e *ndjsonExport) Flush() error {
+	return nil
+}
+
+func (e *ndjsonExport) Close() error {
+	return nil
+}
+
+type jsonExport struct {
+	w     io.Writer
+	first bool
+}
+
+func newJSONExport(w io.Writer) (exportWriter, error) {
+	_, err := io.WriteString(w, "[")
+	return &jsonExport{w: w, first: true}, err
+}
+
+func (e *jsonExport) Write(url RespShortURL) error {
+	data, err := json.Marshal(url)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		data = append([]byte{','}, data...)
+	}
+	e.first = false
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExport) Flush() error {
+	return nil
+}
+
+func (e *jsonExport) Close() error {
+	_, err := io.WriteString(e.w, "]")
+	return err
+}
@@ -9,12 +9,13 @@ import (
 	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
 	"github.com/Vrg26/shortener-tpl/internal/app/types"
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgerrcode"
-	"github.com/lib/pq"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,22 +24,63 @@ var _ handlers.Handler = &handler{}
 type handler struct {
 	shortURLService Service
 	baseURL         string
+	imports         *importJobs
+	maxBatchSize    int
 }
 
 const userKey types.ContextKey = 0
 
+const (
+	DefaultMaxBatchSize = 1000
+	maxBatchEntrySize   = 8 << 10
+)
+
+var (
+	errBatchTooLarge = errors.New("batch too large")
+	errNotArray      = errors.New("request body must be a JSON array")
+)
+
 func NewHandler(service Service, baseURL string) *handler {
-	return &handler{shortURLService: service, baseURL: baseURL}
+	return &handler{shortURLService: service, baseURL: baseURL, imports: newImportJobs(), maxBatchSize: DefaultMaxBatchSize}
+}
+
+// SetMaxBatchSize limits the urls of one batch request; zero lifts the limit.
+func (h *handler) SetMaxBatchSize(n int) {
+	h.maxBatchSize = n
+}
+
+// Shutdown cancels running imports and waits for them to stop, or for ctx.
+func (h *handler) Shutdown(ctx context.Context) error {
+	return h.imports.close(ctx)
 }
 
 func (h *handler) Register(r *chi.Mux) {
 	r.Get("/{ID}", h.GetURL)
+	r.Head("/{ID}", h.GetURL)
 	r.Get("/api/user/urls", h.GetURLsByUserID)
+	r.Get("/api/user/urls/export", h.ExportURLs)
+	r.Post("/api/user/urls/import", h.ImportURLs)
+	r.Get("/api/user/imports/{jobID}", h.GetImport)
+	r.Patch("/api/user/urls/{ID}", h.UpdateURL)
+	r.Get("/api/user/urls/{ID}/history", h.GetHistory)
+	r.Post("/api/user/urls/{ID}/rollback", h.Rollback)
+	r.Get("/api/user/tags", h.ListTags)
+	r.Patch("/api/user/tags/{tag}", h.RenameTag)
+	r.Post("/api/user/tags/merge", h.MergeTags)
 	r.Post("/", h.AddTextURL)
 	r.Post("/api/shorten", h.AddJSONURL)
 	r.Post("/api/shorten/batch", h.AddBatchURL)
+	r.Post("/api/shorten/batch/stream", h.AddBatchStream)
+	r.Post("/api/expand", h.Expand)
+	r.Get("/api/lookup", h.Lookup)
 }
 
+// GetURLsByUserID lists the user's links. Optional parameters: q (substring of
+// the destination), tag (repeatable, all must match), folder, created_after and created_before (RFC 3339 or a date),
+// sort (created_at, original_url, prefixed with "-" for descending; newest
+// first by default), limit (up to maxPageLimit) and cursor, taken from the
+// X-Next-Cursor header of the previous page. Without a limit every link is
+// returned.
 func (h *handler) GetURLsByUserID(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
@@ -49,25 +91,38 @@ func (h *handler) GetURLsByUserID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urls, err := h.shortURLService.GetURLsByUserID(ctx, userID)
+	query, err := parseURLQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.UserID = userID
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	page, err := h.shortURLService.ListURLs(ctx, query)
+	if errors.Is(err, db.ErrInvalidSort) || errors.Is(err, db.ErrInvalidCursor) || errors.Is(err, db.ErrInvalidLabel) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
 	}
-	respUrls := make([]RespShortURL, len(urls))
-	if len(urls) == 0 {
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	respUrls := make([]RespShortURL, len(page.URLs))
+	if len(page.URLs) == 0 {
 		resp, _ := json.Marshal(respUrls)
 		w.WriteHeader(http.StatusNoContent)
 		w.Write(resp)
 		return
 	}
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
 
-	for index, url := range urls {
-		respUrls[index] = RespShortURL{
-			ShortURL:    fmt.Sprintf("%s/%s", h.baseURL, url.ID),
-			OriginalURL: url.OriginURL,
-		}
+	for index, url := range page.URLs {
+		respUrls[index] = h.respShortURL(url)
 	}
 	resp, err := json.Marshal(respUrls)
 
@@ -78,8 +133,50 @@ func (h *handler) GetURLsByUserID(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
+const maxPageLimit = 1000
+
+func parseURLQuery(values url.Values) (db.URLQuery, error) {
+	q := db.URLQuery{
+		Search: values.Get("q"),
+		Tags:   values["tag"],
+		Folder: values.Get("folder"),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	var err error
+	if q.CreatedAfter, err = parseDate(values.Get("created_after")); err != nil {
+		return q, fmt.Errorf("invalid created_after: %w", err)
+	}
+	if q.CreatedBefore, err = parseDate(values.Get("created_before")); err != nil {
+		return q, fmt.Errorf("invalid created_before: %w", err)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > maxPageLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return q, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// GetURL redirects to the destination and counts the click. HEAD requests
+// are answered without counting. Requests for info, by ?info or Accept:
+// application/json, get the link's metadata instead. An ID ending in "+", or
+// a link with preview set, gets a preview page unless ?continue is given.
 func (h *handler) GetURL(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "ID")
+	preview := strings.HasSuffix(id, "+")
+	id = strings.TrimSuffix(id, "+")
 	if id == "" {
 		http.Error(w, "Empty path", http.StatusBadRequest)
 		return
@@ -88,12 +185,44 @@ func (h *handler) GetURL(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
+	w.Header().Add("Vary", "Accept")
 	shortURL, err := h.shortURLService.GetByID(ctx, id)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
-	http.Redirect(w, r, shortURL.OriginURL, http.StatusTemporaryRedirect)
+
+	_, info := r.URL.Query()["info"]
+	_, skipPreview := r.URL.Query()["continue"]
+	switch {
+	case info || acceptsJSON(r):
+		userID, _ := ctx.Value(userKey).(uint32)
+		resp, err := json.Marshal(h.linkInfo(shortURL, userID))
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(resp)
+	case preview || (shortURL.Preview && !skipPreview):
+		h.writePreview(w, r.WithContext(ctx), shortURL)
+	default:
+		if r.Method != http.MethodHead {
+			h.shortURLService.CountClick(ctx, id)
+		}
+		http.Redirect(w, r, shortURL.OriginURL, http.StatusTemporaryRedirect)
+	}
+}
+
+// acceptsJSON reports whether the Accept header names application/json, so
+// browsers asking for anything keep getting redirects.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *handler) AddBatchURL(w http.ResponseWriter, r *http.Request) {
@@ -105,10 +234,26 @@ func (h *handler) AddBatchURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var rBody []RequestBatchURL
-	if err := json.NewDecoder(r.Body).Decode(&rBody); err != nil {
+	err := h.decodeBatch(w, r, func(dec *json.Decoder) error {
+		var reqURL RequestBatchURL
+		if err := dec.Decode(&reqURL); err != nil {
+			return err
+		}
+		rBody = append(rBody, reqURL)
+		return nil
+	})
+	if errors.Is(err, errBatchTooLarge) {
+		http.Error(w, fmt.Sprintf("batch is limited to %d urls", h.maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if r.URL.Query().Get("partial") == "true" || r.Header.Get("X-Batch-Mode") == "partial" {
+		h.addBatchPartial(w, r, rBody, userID)
+		return
+	}
 	shortUrls := make([]db.ShortURL, len(rBody))
 	for index, reqURL := range rBody {
 		if reqURL.OriginalURL == "" {
@@ -120,7 +265,12 @@ func (h *handler) AddBatchURL(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintf("invalid url in the record with id %s", reqURL.CorrelationID), http.StatusBadRequest)
 			return
 		}
-		shortUrls[index] = db.ShortURL{OriginURL: reqURL.OriginalURL, CorrelationID: reqURL.CorrelationID}
+		shortUrls[index] = db.ShortURL{
+			OriginURL:     reqURL.OriginalURL,
+			CorrelationID: reqURL.CorrelationID,
+			Tags:          reqURL.Tags,
+			Folder:        reqURL.Folder,
+		}
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
@@ -128,6 +278,14 @@ func (h *handler) AddBatchURL(w http.ResponseWriter, r *http.Request) {
 
 	resultURLs, err := h.shortURLService.AddBatchURL(ctx, shortUrls, userID)
 
+	if errors.Is(err, db.ErrInvalidLabel) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, db.ErrConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -154,6 +312,87 @@ func (h *handler) AddBatchURL(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// addBatchPartial shortens what it can of a batch and reports the status of
+// each url instead of failing the whole request.
+// decodeBatch reads the JSON array in the body entry by entry with decode.
+// It stops with errBatchTooLarge at the first entry past maxBatchSize instead
+// of reading the rest, and the body is capped at maxBatchEntrySize bytes per
+// entry, so one oversized entry cannot be buffered either.
+func (h *handler) decodeBatch(w http.ResponseWriter, r *http.Request, decode func(dec *json.Decoder) error) error {
+	if h.maxBatchSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(h.maxBatchSize)*maxBatchEntrySize)
+	}
+	dec := json.NewDecoder(r.Body)
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('[') {
+		return errNotArray
+	}
+	for n := 0; dec.More(); n++ {
+		if h.maxBatchSize > 0 && n == h.maxBatchSize {
+			return errBatchTooLarge
+		}
+		if err := decode(dec); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func (h *handler) addBatchPartial(w http.ResponseWriter, r *http.Request, rBody []RequestBatchURL, userID uint32) {
+	shortUrls := make([]db.ShortURL, len(rBody))
+	for index, reqURL := range rBody {
+		shortUrls[index] = batchLink(reqURL)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	results, err := h.shortURLService.AddBatchPartial(ctx, shortUrls, userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	respUrls := make([]ResponseBatchURL, len(results))
+	for index, result := range results {
+		respUrls[index] = h.batchResponse(result)
+	}
+	resp, err := json.Marshal(respUrls)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+func batchLink(reqURL RequestBatchURL) db.ShortURL {
+	return db.ShortURL{
+		OriginURL:     reqURL.OriginalURL,
+		CorrelationID: reqURL.CorrelationID,
+		Tags:          reqURL.Tags,
+		Folder:        reqURL.Folder,
+	}
+}
+
+func (h *handler) batchResponse(result BatchResult) ResponseBatchURL {
+	resp := ResponseBatchURL{
+		CorrelationID: result.CorrelationID,
+		Status:        result.Status,
+		Reason:        result.Reason,
+	}
+	if result.Status != BatchInvalid {
+		resp.ShortURL = fmt.Sprintf("%s/%s", h.baseURL, result.ID)
+	}
+	return resp
+}
+
 func (h *handler) AddJSONURL(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(userKey).(uint32)
 
@@ -182,10 +421,13 @@ func (h *handler) AddJSONURL(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	newID, err := h.shortURLService.Add(ctx, rBody.URL, userID)
+	newID, err := h.shortURLService.Add(ctx, rBody.URL, userID, Labels{Tags: rBody.Tags, Folder: rBody.Folder})
 	if err != nil {
-		var pe *pq.Error
-		if errors.As(err, &pe) && pgerrcode.IsIntegrityConstraintViolation(string(pe.Code)) {
+		if errors.Is(err, db.ErrInvalidLabel) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, db.ErrConflict) {
 
 			newID, err = h.shortURLService.GetByOriginalURL(ctx, rBody.URL)
 			if err != nil {
@@ -255,11 +497,15 @@ func (h *handler) AddTextURL(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	newID, err := h.shortURLService.Add(ctx, originURL, userID)
+	labels := Labels{Tags: r.URL.Query()["tag"], Folder: r.URL.Query().Get("folder")}
+	newID, err := h.shortURLService.Add(ctx, originURL, userID, labels)
 	if err != nil {
+		if errors.Is(err, db.ErrInvalidLabel) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		var pe *pq.Error
-		if errors.As(err, &pe) && pgerrcode.IsIntegrityConstraintViolation(string(pe.Code)) {
+		if errors.Is(err, db.ErrConflict) {
 
 			newID, err = h.shortURLService.GetByOriginalURL(ctx, originURL)
 			if err != nil {
@@ -281,3 +527,251 @@ func (h *handler) AddTextURL(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(fmt.Sprintf("%s/%s", h.baseURL, newID)))
 }
+
+func (h *handler) UpdateURL(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var rBody RequestUpdateURL
+	if err := json.NewDecoder(r.Body).Decode(&rBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labelled := rBody.Tags != nil || rBody.Folder != nil
+	if rBody.URL == "" && !labelled && rBody.Preview == nil {
+		http.Error(w, "url, tags, folder or preview is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := url.ParseRequestURI(rBody.URL); rBody.URL != "" && err != nil {
+		http.Error(w, "url is invalid", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	id := chi.URLParam(r, "ID")
+	var shortURL db.ShortURL
+	var err error
+	if labelled {
+		if shortURL, err = h.shortURLService.UpdateLabels(ctx, id, rBody.Tags, rBody.Folder, userID); err != nil {
+			writeEditError(w, r, err)
+			return
+		}
+	}
+	if rBody.Preview != nil {
+		if shortURL, err = h.shortURLService.SetPreview(ctx, id, *rBody.Preview, userID); err != nil {
+			writeEditError(w, r, err)
+			return
+		}
+	}
+	if rBody.URL != "" {
+		if shortURL, err = h.shortURLService.UpdateURL(ctx, id, rBody.URL, userID); err != nil {
+			writeEditError(w, r, err)
+			return
+		}
+	}
+	h.writeShortURL(w, shortURL)
+}
+
+func (h *handler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	revs, err := h.shortURLService.GetHistory(ctx, chi.URLParam(r, "ID"), userID)
+	if err != nil {
+		writeEditError(w, r, err)
+		return
+	}
+
+	respRevs := make([]RespRevision, len(revs))
+	for index, rev := range revs {
+		respRevs[index] = RespRevision{
+			Version:     rev.Version,
+			OriginalURL: rev.OriginURL,
+			EditorID:    rev.EditorID,
+			EditedAt:    rev.EditedAt,
+		}
+	}
+	resp, err := json.Marshal(respRevs)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+func (h *handler) Rollback(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var rBody RequestRollback
+	if err := json.NewDecoder(r.Body).Decode(&rBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	shortURL, err := h.shortURLService.Rollback(ctx, chi.URLParam(r, "ID"), rBody.Version, userID)
+	if err != nil {
+		writeEditError(w, r, err)
+		return
+	}
+	h.writeShortURL(w, shortURL)
+}
+
+func (h *handler) ListTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	tags, err := h.shortURLService.ListTags(ctx, userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	respTags := make([]RespTag, len(tags))
+	for index, tag := range tags {
+		respTags[index] = RespTag{Tag: tag.Tag, Count: tag.Count}
+	}
+	resp, err := json.Marshal(respTags)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if len(tags) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	w.Write(resp)
+}
+
+func (h *handler) RenameTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var rBody RequestRenameTag
+	if err := json.NewDecoder(r.Body).Decode(&rBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	updated, err := h.shortURLService.RenameTag(ctx, userID, chi.URLParam(r, "tag"), rBody.Name)
+	if err != nil {
+		writeEditError(w, r, err)
+		return
+	}
+	writeTagUpdate(w, updated)
+}
+
+func (h *handler) MergeTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var rBody RequestMergeTags
+	if err := json.NewDecoder(r.Body).Decode(&rBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rBody.Tags) == 0 {
+		http.Error(w, "tags are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	updated, err := h.shortURLService.MergeTags(ctx, userID, rBody.Tags, rBody.Into)
+	if err != nil {
+		writeEditError(w, r, err)
+		return
+	}
+	writeTagUpdate(w, updated)
+}
+
+func writeTagUpdate(w http.ResponseWriter, updated int) {
+	resp, err := json.Marshal(RespTagUpdate{Updated: updated})
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+func (h *handler) respShortURL(shortURL db.ShortURL) RespShortURL {
+	return RespShortURL{
+		ShortURL:    fmt.Sprintf("%s/%s", h.baseURL, shortURL.ID),
+		OriginalURL: shortURL.OriginURL,
+		CreatedAt:   shortURL.CreatedAt,
+		Tags:        shortURL.Tags,
+		Folder:      shortURL.Folder,
+		Clicks:      shortURL.Clicks,
+		Preview:     shortURL.Preview,
+	}
+}
+
+func (h *handler) writeShortURL(w http.ResponseWriter, shortURL db.ShortURL) {
+	resp, err := json.Marshal(h.respShortURL(shortURL))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+func writeEditError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, ErrUnknownRevision):
+		http.NotFound(w, r)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, db.ErrInvalidLabel):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, db.ErrConflict), errors.Is(err, ErrTagExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
@@ -1,18 +1,25 @@
 package shorturl
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/middlewares"
 	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string) (*http.Response, string) {
@@ -234,3 +241,753 @@ func Test_handler_GetUrl(t *testing.T) {
 		})
 	}
 }
+
+func withUser(userID uint32) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, userID)))
+		})
+	}
+}
+
+func Test_handler_UpdateURL(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+
+	idURL, err := st.Add(context.Background(), "https://example.com", 1)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		userID     uint32
+		id         string
+		body       string
+		statusCode int
+	}{
+		{name: "success test", userID: 1, id: idURL, body: `{"url":"https://example.org"}`, statusCode: 200},
+		{name: "should return forbidden for another user", userID: 2, id: idURL, body: `{"url":"https://example.net"}`, statusCode: 403},
+		{name: "should return not found", userID: 1, id: "missing", body: `{"url":"https://example.net"}`, statusCode: 404},
+		{name: "should return bad request. Invalid URL", userID: 1, id: idURL, body: `{"url":"testestset"}`, statusCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Use(withUser(tt.userID))
+			h.Register(r)
+
+			request := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+tt.id, bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+			assert.Equal(t, tt.statusCode, w.Code)
+		})
+	}
+
+	shortURL, err := st.GetByID(context.Background(), idURL)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.org", shortURL.OriginURL)
+}
+
+func Test_handler_HistoryAndRollback(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	idURL, err := st.Add(ctx, "https://example.com/v1", 1)
+	require.NoError(t, err)
+	_, err = s.UpdateURL(ctx, idURL, "https://example.com/v2", 1)
+	require.NoError(t, err)
+	_, err = s.UpdateURL(ctx, idURL, "https://example.com/v3", 1)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls/"+idURL+"/history", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var revs []RespRevision
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&revs))
+	require.Len(t, revs, 2)
+	assert.Equal(t, "https://example.com/v1", revs[0].OriginalURL)
+	assert.Equal(t, 2, revs[1].Version)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/user/urls/"+idURL+"/rollback", bytes.NewBufferString(`{"version":1}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var result RespShortURL
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, "https://example.com/v1", result.OriginalURL)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/user/urls/"+idURL+"/rollback", bytes.NewBufferString(`{"version":9}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	history, err := st.GetHistory(ctx, idURL)
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+}
+
+func Test_handler_GetURLsByUserID(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	base := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i, link := range []string{"https://example.com/a", "https://example.org/b", "https://example.com/c"} {
+		require.NoError(t, st.Save(ctx, db.ShortURL{ID: fmt.Sprint(i), OriginURL: link, UserID: 1, CreatedAt: base.AddDate(0, 0, i)}))
+	}
+
+	get := func(query string) (*httptest.ResponseRecorder, []RespShortURL) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls"+query, nil))
+		var urls []RespShortURL
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &urls))
+		}
+		return w, urls
+	}
+
+	w, urls := get("?q=EXAMPLE.COM&limit=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, urls, 1)
+	assert.Equal(t, RespShortURL{ShortURL: "http://localhost/2", OriginalURL: "https://example.com/c", CreatedAt: base.AddDate(0, 0, 2)}, urls[0])
+
+	w, urls = get("?q=EXAMPLE.COM&limit=1&cursor=" + w.Header().Get("X-Next-Cursor"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, urls, 1)
+	assert.Equal(t, "https://example.com/a", urls[0].OriginalURL)
+	assert.Empty(t, w.Header().Get("X-Next-Cursor"))
+
+	_, urls = get("?sort=created_at&created_after=2022-10-02&created_before=2022-10-03T00:00:00Z")
+	require.Len(t, urls, 1)
+	assert.Equal(t, "https://example.org/b", urls[0].OriginalURL)
+
+	w, _ = get("?created_after=2023-01-01")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	for _, query := range []string{"?limit=0", "?limit=5000", "?sort=size", "?cursor=bad", "?created_after=yesterday"} {
+		w, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func Test_handler_Labels(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	idOf := func(w *httptest.ResponseRecorder) string {
+		var res RespResultURL
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.Result[len("http://localhost/"):]
+	}
+
+	w := send(http.MethodPost, "/api/shorten", `{"url":"https://example.com/a","tags":["Promo"," q4 "],"folder":"Campaigns"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	first := idOf(w)
+	w = send(http.MethodPost, "/?tag=promo&folder=Blog", "https://example.com/b")
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = send(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://example.com/c","tags":["q4"]}]`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = send(http.MethodPost, "/api/shorten", `{"url":"https://example.com/d","tags":["a,b"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	shortURL, err := st.GetByID(context.Background(), first)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"promo", "q4"}, shortURL.Tags)
+	assert.Equal(t, "Campaigns", shortURL.Folder)
+
+	w = send(http.MethodGet, "/api/user/urls?tag=PROMO&folder=Campaigns", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var urls []RespShortURL
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &urls))
+	require.Len(t, urls, 1)
+	assert.Equal(t, []string{"promo", "q4"}, urls[0].Tags)
+
+	w = send(http.MethodPatch, "/api/user/urls/"+first, `{"tags":["launch"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var updated RespShortURL
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, []string{"launch"}, updated.Tags)
+	assert.Equal(t, "Campaigns", updated.Folder)
+
+	w = send(http.MethodGet, "/api/user/tags", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"tag":"launch","count":1},{"tag":"promo","count":1},{"tag":"q4","count":1}]`, w.Body.String())
+
+	assert.Equal(t, http.StatusConflict, send(http.MethodPatch, "/api/user/tags/launch", `{"name":"promo"}`).Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPatch, "/api/user/tags/missing", `{"name":"other"}`).Code)
+	w = send(http.MethodPatch, "/api/user/tags/launch", `{"name":"Spring Launch"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"updated":1}`, w.Body.String())
+
+	w = send(http.MethodPost, "/api/user/tags/merge", `{"tags":["q4","spring launch"],"into":"promo"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"updated":2}`, w.Body.String())
+	w = send(http.MethodGet, "/api/user/tags", "")
+	assert.JSONEq(t, `[{"tag":"promo","count":3}]`, w.Body.String())
+}
+
+func Test_handler_ExportURLs(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	r.Use(middlewares.Gzip)
+	h.Register(r)
+
+	ctx := context.Background()
+	base := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "a", OriginURL: "https://example.com/a", UserID: 1, CreatedAt: base, Tags: []string{"promo", "q4"}, Folder: "Campaigns"}))
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "b", OriginURL: "https://example.com/b?x=1,2", UserID: 1, CreatedAt: base.Add(time.Hour)}))
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "c", OriginURL: "https://example.com/c", UserID: 2, CreatedAt: base}))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a", nil))
+		require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	}
+
+	export := func(format string, gzipped bool) (*httptest.ResponseRecorder, string) {
+		request := httptest.NewRequest(http.MethodGet, "/api/user/urls/export?format="+format, nil)
+		if gzipped {
+			request.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		if !gzipped {
+			return w, w.Body.String()
+		}
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		gzr, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gzr)
+		require.NoError(t, err)
+		return w, string(body)
+	}
+
+	w, body := export("csv", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "short_url,original_url,created_at,tags,folder,clicks\n"+
+		"http://localhost/a,https://example.com/a,2022-10-01T00:00:00Z,\"promo,q4\",Campaigns,2\n"+
+		"http://localhost/b,\"https://example.com/b?x=1,2\",2022-10-01T01:00:00Z,,,0\n", body)
+
+	_, body = export("ndjson", false)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"short_url":"http://localhost/a","original_url":"https://example.com/a","created_at":"2022-10-01T00:00:00Z","tags":["promo","q4"],"folder":"Campaigns","clicks":2}`, lines[0])
+
+	_, body = export("json", false)
+	var urls []RespShortURL
+	require.NoError(t, json.Unmarshal([]byte(body), &urls))
+	require.Len(t, urls, 2)
+	assert.Equal(t, "http://localhost/b", urls[1].ShortURL)
+
+	w, _ = export("xml", false)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_handler_ImportURLs(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "taken", OriginURL: "https://example.com/other", UserID: 2}))
+
+	run := func(path, contentType, body string) RespImportJob {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		location := w.Header().Get("Location")
+
+		var job RespImportJob
+		require.Eventually(t, func() bool {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+			return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &job) == nil && job.Status == importDone
+		}, time.Second, 10*time.Millisecond)
+		return job
+	}
+
+	job := run("/api/user/urls/import", "text/csv", "\ufeffBitlink,Long URL,Tags,Date Created,Clicks\n"+
+		"bit.ly/promo,https://example.com/promo,Sale;Q4,2021-05-01 10:00:00,7\n"+
+		"https://bit.ly/taken,https://example.com/taken,,,\n"+
+		"bit.ly/bad,not a url,,,\n"+
+		"bit.ly/late,https://example.com/late,,yesterday,\n")
+	assert.Equal(t, 4, job.Total)
+	assert.Equal(t, 4, job.Processed)
+	assert.Equal(t, 2, job.Created)
+	assert.Equal(t, 2, job.Failed)
+	require.Len(t, job.Errors, 2)
+	assert.Equal(t, RespImportError{Line: 4, OriginalURL: "not a url", Error: "url is invalid"}, job.Errors[0])
+	assert.Equal(t, 5, job.Errors[1].Line)
+	require.Len(t, job.Renamed, 1)
+	assert.Equal(t, "taken", job.Renamed[0].ID)
+	assert.NotEqual(t, "http://localhost/taken", job.Renamed[0].ShortURL)
+
+	promo, err := st.GetByID(ctx, "promo")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/promo", promo.OriginURL)
+	assert.Equal(t, uint32(1), promo.UserID)
+	assert.Equal(t, []string{"q4", "sale"}, promo.Tags)
+	assert.Equal(t, int64(7), promo.Clicks)
+	assert.Equal(t, time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC), promo.CreatedAt.UTC())
+
+	job = run("/api/user/urls/import?url_column=target&id_column=code", "text/csv", "code,target\nmine,https://example.com/mine\nfresh,https://example.com/other\n")
+	assert.Equal(t, 1, job.Created)
+	assert.Equal(t, 1, job.Existing)
+	_, err = st.GetByID(ctx, "mine")
+	assert.NoError(t, err)
+	_, err = st.GetByID(ctx, "fresh")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	job = run("/api/user/urls/import", "application/json", `{"links":{"link_2":{"shorturl":"https://sho.rt/yo","url":"https://example.com/yo","timestamp":"2020-01-02 03:04:05","clicks":"3"},"link_1":{"shorturl":"https://sho.rt/mine","url":"https://example.com/dup"}}}`)
+	assert.Equal(t, 2, job.Created)
+	require.Len(t, job.Renamed, 1)
+	assert.Equal(t, 1, job.Renamed[0].Line)
+	yo, err := st.GetByID(ctx, "yo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), yo.Clicks)
+
+	for _, tt := range []struct {
+		path string
+		body string
+	}{
+		{"/api/user/urls/import", "id,name\n1,x\n"},
+		{"/api/user/urls/import?url_column=missing", "url\nhttps://example.com\n"},
+		{"/api/user/urls/import", "url\n"},
+		{"/api/user/urls/import?format=xml", "url\nhttps://example.com\n"},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.path)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/imports/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_importJobs_Limits(t *testing.T) {
+	jobs := newImportJobs()
+	var started []*importJob
+	for i := 0; i < maxUserImports; i++ {
+		job, err := jobs.start(1, 1)
+		require.NoError(t, err)
+		started = append(started, job)
+	}
+	_, err := jobs.start(1, 1)
+	assert.ErrorIs(t, err, errTooManyImports)
+	for i := maxUserImports; i < maxRunningImports; i++ {
+		job, err := jobs.start(uint32(i+2), 1)
+		require.NoError(t, err)
+		started = append(started, job)
+	}
+	_, err = jobs.start(100, 1)
+	assert.ErrorIs(t, err, errTooManyImports)
+
+	jobs.done(started[0])
+	_, err = jobs.start(1, 1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, jobs.close(ctx), context.DeadlineExceeded)
+	assert.Error(t, jobs.ctx.Err())
+	_, err = jobs.start(200, 1)
+	assert.ErrorIs(t, err, errImportsShutdown)
+}
+
+func Test_handler_ShutdownCancelsImports(t *testing.T) {
+	h := NewHandler(*NewService(db.NewMemoryStorage()), "http://localhost")
+	job, err := h.imports.start(1, 1)
+	require.NoError(t, err)
+	h.imports.cancel()
+	go h.runImport(job, []importRecord{{row: ImportRow{Line: 1, OriginURL: "https://example.com"}}}, 1)
+	require.NoError(t, h.Shutdown(context.Background()))
+
+	status := job.status()
+	assert.Equal(t, importCanceled, status.Status)
+	assert.Equal(t, 0, status.Processed)
+}
+
+func Test_handler_AddBatchURLPartial(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	h.SetMaxBatchSize(5)
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "old", OriginURL: "https://example.com/old", UserID: 2}))
+
+	body := `[{"correlation_id":"1","original_url":"https://example.com/new"},
+		{"correlation_id":"2","original_url":"not a url"},
+		{"correlation_id":"3","original_url":"https://example.com/old"},
+		{"correlation_id":"4","original_url":"https://example.com/new"},
+		{"correlation_id":"5","original_url":"https://example.com/tagged","tags":["a,b"]}]`
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten/batch?partial=true", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp []ResponseBatchURL
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp, 5)
+	assert.Equal(t, BatchCreated, resp[0].Status)
+	assert.Equal(t, ResponseBatchURL{CorrelationID: "2", Status: BatchInvalid, Reason: "url is invalid"}, resp[1])
+	assert.Equal(t, ResponseBatchURL{CorrelationID: "3", ShortURL: "http://localhost/old", Status: BatchExisting}, resp[2])
+	assert.Equal(t, ResponseBatchURL{CorrelationID: "4", ShortURL: resp[0].ShortURL, Status: BatchExisting}, resp[3])
+	assert.Equal(t, BatchInvalid, resp[4].Status)
+	assert.Equal(t, db.ErrInvalidLabel.Error(), resp[4].Reason)
+
+	urls, err := st.GetURLsByUserID(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 1)
+
+	request = httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(`[{"correlation_id":"1","original_url":"not a url"}]`))
+	request.Header.Set("X-Batch-Mode", "partial")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/shorten/batch?partial=true", strings.NewReader(`[{},{},{},{},{},{}]`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	huge := `[{"original_url":"https://example.com/` + strings.Repeat("a", 5*maxBatchEntrySize) + `"}]`
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(huge)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(`{"original_url":"https://example.com"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// racingStorage behaves as if another request shortened taken between the
+// lookup and the insert of a batch. Like a storage without transactions, it
+// keeps the links of the batch added before taken.
+type racingStorage struct {
+	db.Storage
+	taken string
+}
+
+func (s racingStorage) AddBatchURL(ctx context.Context, urls []db.ShortURL, userID uint32) ([]db.ShortURL, error) {
+	for index, url := range urls {
+		if url.OriginURL == s.taken {
+			if _, err := s.Storage.AddBatchURL(ctx, urls[:index], userID); err != nil {
+				return nil, err
+			}
+			return nil, s.race(ctx)
+		}
+	}
+	return s.Storage.AddBatchURL(ctx, urls, userID)
+}
+
+func (s racingStorage) Add(ctx context.Context, url string, userID uint32) (string, error) {
+	if url == s.taken {
+		return "", s.race(ctx)
+	}
+	return s.Storage.Add(ctx, url, userID)
+}
+
+func (s racingStorage) race(ctx context.Context) error {
+	if err := s.Storage.Save(ctx, db.ShortURL{ID: "raced", OriginURL: s.taken}); err != nil {
+		return err
+	}
+	return db.ErrConflict
+}
+
+func TestService_AddBatchPartialConflict(t *testing.T) {
+	s := NewService(racingStorage{Storage: db.NewMemoryStorage(), taken: "https://example.com/b"})
+	results, err := s.AddBatchPartial(context.Background(), []db.ShortURL{
+		{OriginURL: "https://example.com/a", Tags: []string{"x"}},
+		{OriginURL: "https://example.com/b"},
+	}, 1)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, BatchCreated, results[0].Status, "added before the conflict")
+	assert.Equal(t, BatchExisting, results[1].Status)
+	assert.Equal(t, "raced", results[1].ID)
+
+	url, err := s.GetByID(context.Background(), results[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x"}, url.Tags)
+}
+
+func Test_handler_AddBatchStream(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	body, upload := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/shorten/batch/stream", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	go fmt.Fprintln(upload, `{"correlation_id":"1","original_url":"https://example.com/1"}`)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	results := bufio.NewScanner(resp.Body)
+
+	next := func() ResponseBatchURL {
+		require.True(t, results.Scan(), results.Err())
+		var result ResponseBatchURL
+		require.NoError(t, json.Unmarshal(results.Bytes(), &result))
+		return result
+	}
+
+	// The first result arrives while the upload is still open.
+	first := next()
+	assert.Equal(t, "1", first.CorrelationID)
+	assert.Equal(t, BatchCreated, first.Status)
+
+	fmt.Fprint(upload, `{"correlation_id":"2","original_url":"https://example.com/1"}`+"\n"+
+		"not json\n\n"+
+		`{"correlation_id":"3","original_url":"https://example.com/3"}`)
+	upload.Close()
+
+	assert.Equal(t, ResponseBatchURL{CorrelationID: "2", ShortURL: first.ShortURL, Status: BatchExisting}, next())
+	assert.Equal(t, ResponseBatchURL{Status: BatchInvalid, Reason: "line 3: invalid json"}, next())
+	assert.Equal(t, BatchCreated, next().Status)
+	assert.False(t, results.Scan())
+
+	urls, err := st.GetURLsByUserID(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Len(t, urls, 2)
+}
+
+func Test_handler_ExpandAndLookup(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "https://sho.rt")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	created := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "mine", OriginURL: "https://example.com/a", UserID: 1, CreatedAt: created, Tags: []string{"x"}, Clicks: 4}))
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "theirs", OriginURL: "https://example.com/b", UserID: 2, CreatedAt: created, Clicks: 9}))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/expand", strings.NewReader(
+		`["mine", "https://sho.rt/theirs", "sho.rt/mine", "https://other.host/mine", "missing"]`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[
+		{"input":"mine","short_url":"https://sho.rt/mine","original_url":"https://example.com/a","created_at":"2022-10-01T00:00:00Z","tags":["x"],"clicks":4},
+		{"input":"https://sho.rt/theirs","short_url":"https://sho.rt/theirs","original_url":"https://example.com/b","created_at":"2022-10-01T00:00:00Z"},
+		{"input":"sho.rt/mine","short_url":"https://sho.rt/mine","original_url":"https://example.com/a","created_at":"2022-10-01T00:00:00Z","tags":["x"],"clicks":4},
+		{"input":"https://other.host/mine","error":"not a short url of this service"},
+		{"input":"missing","error":"not found"}
+	]`, w.Body.String())
+
+	shortURL, err := st.GetByID(ctx, "mine")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), shortURL.Clicks)
+
+	h.SetMaxBatchSize(2)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/expand", strings.NewReader(`["mine", "mine", "mine"]`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/expand", strings.NewReader(`["`+strings.Repeat("a", 3*maxBatchEntrySize)+`"]`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "again", OriginURL: "https://example.com/a", UserID: 1, CreatedAt: created.Add(time.Hour)}))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/lookup?url="+url.QueryEscape("https://example.com/a"), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var lookup RespLookup
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &lookup))
+	assert.ElementsMatch(t, []string{"https://sho.rt/mine", "https://sho.rt/again"}, lookup.ShortURLs)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/lookup?url="+url.QueryEscape("https://example.com/none"), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/lookup?url=nope", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_handler_GetURLInfo(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	created := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "mine", OriginURL: "https://example.com/a", UserID: 1, CreatedAt: created, Clicks: 3}))
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "theirs", OriginURL: "https://example.com/b", UserID: 2, CreatedAt: created, Clicks: 5}))
+
+	get := func(method, path, accept string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w
+	}
+
+	w := get(http.MethodGet, "/mine?info", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"short_url":"http://localhost/mine","original_url":"https://example.com/a","created_at":"2022-10-01T00:00:00Z","clicks":3}`, w.Body.String())
+
+	w = get(http.MethodGet, "/theirs", "application/json; q=0.9")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"short_url":"http://localhost/theirs","original_url":"https://example.com/b","created_at":"2022-10-01T00:00:00Z"}`, w.Body.String())
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+	w = get(http.MethodHead, "/mine", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://example.com/a", w.Header().Get("Location"))
+
+	w = get(http.MethodHead, "/missing", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = get(http.MethodGet, "/missing?info", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = get(http.MethodGet, "/mine", "text/html,application/xhtml+xml,*/*;q=0.8")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	shortURL, err := st.GetByID(ctx, "mine")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), shortURL.Clicks)
+}
+
+func Test_handler_Preview(t *testing.T) {
+	st := db.NewMemoryStorage()
+	s := NewService(st)
+	h := NewHandler(*s, "http://localhost")
+	r := chi.NewRouter()
+	r.Use(withUser(1))
+	h.Register(r)
+
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, db.ShortURL{ID: "abc", OriginURL: "https://example.com/some/page?x=1", UserID: 1, Title: "Example <Domain>"}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/abc+")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "<strong>example.com</strong>")
+	assert.Contains(t, body, "<h1>Example &lt;Domain&gt;</h1>")
+	assert.Contains(t, body, "https://example.com/some/page?x=1")
+	assert.Contains(t, body, `action="http://localhost/abc"`)
+
+	assert.Equal(t, http.StatusTemporaryRedirect, get("/abc").Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/api/user/urls/abc", strings.NewReader(`{"preview":true}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp RespShortURL
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Preview)
+
+	assert.Equal(t, http.StatusOK, get("/abc").Code)
+	w = get("/abc?continue=")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://example.com/some/page?x=1", w.Header().Get("Location"))
+
+	shortURL, err := st.GetByID(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), shortURL.Clicks)
+
+	assert.Equal(t, http.StatusNotFound, get("/missing+").Code)
+}
+
+func TestTitleFetcher(t *testing.T) {
+	st := db.NewMemoryStorage()
+	titles := newTitleFetcher(st, func(ctx context.Context, url string) string {
+		if url == "https://example.com/untitled" {
+			return ""
+		}
+		return "Title of " + url
+	})
+	defer titles.Close()
+	s := NewService(st)
+	s.SetTitleFetcher(titles)
+	ctx := context.Background()
+
+	title := func(id string) string {
+		shortURL, err := st.GetByID(ctx, id)
+		require.NoError(t, err)
+		return shortURL.Title
+	}
+	id, err := s.Add(ctx, "https://example.com/page", 1, Labels{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return title(id) == "Title of https://example.com/page"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = s.UpdateURL(ctx, id, "https://example.com/untitled", 1)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return title(id) == ""
+	}, time.Second, 10*time.Millisecond)
+
+	titles.store(titleRequest{id: id, url: "https://example.com/page"})
+	assert.Empty(t, title(id), "a link edited since it was queued keeps its title")
+}
+
+func Test_publicOnly(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"93.184.216.34:443":  true,
+		"127.0.0.1:80":       false,
+		"10.1.2.3:80":        false,
+		"192.168.0.1:80":     false,
+		"169.254.169.254:80": false,
+		"[::1]:80":           false,
+		"0.0.0.0:80":         false,
+		"0.1.2.3:80":         false,
+		"100.64.0.1:80":      false,
+		"100.127.255.254:80": false,
+		"100.128.0.1:80":     true,
+	} {
+		err := publicOnly("tcp", address, nil)
+		assert.Equal(t, allowed, err == nil, address)
+	}
+	assert.Equal(t, "a & b", pageTitle([]byte("<html><TITLE lang=en>\n a &amp;\n b</TITLE>")))
+	assert.Empty(t, pageTitle([]byte("<html><body>no title")))
+}
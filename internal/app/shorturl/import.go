@@ -0,0 +1,529 @@
+package shorturl
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxImportSize     = 32 << 20
+	maxImportReported = 1000
+	importJobTTL      = 24 * time.Hour
+	maxRunningImports = 8
+	maxUserImports    = 2
+
+	importRunning  = "running"
+	importDone     = "done"
+	importCanceled = "canceled"
+)
+
+var (
+	errNoImportRows    = errors.New("no links to import")
+	errNoURLColumn     = errors.New("no destination column found, set url_column")
+	errTooManyImports  = errors.New("too many imports running, try again later")
+	errImportsShutdown = errors.New("server is shutting down")
+)
+
+// importColumns lists the headers each field is read from, in order of
+// preference. They cover Bitly exports and this service's own csv export;
+// the param overrides them for other files.
+var importColumns = []struct {
+	field   string
+	param   string
+	headers []string
+}{
+	{"url", "url_column", []string{"long_url", "original_url", "destination", "url"}},
+	{"id", "id_column", []string{"id", "keyword", "custom_bitlinks", "custom_bitlink", "bitlink", "short_url", "link"}},
+	{"tags", "tags_column", []string{"tags", "tag"}},
+	{"folder", "folder_column", []string{"folder", "group"}},
+	{"created", "created_column", []string{"created_at", "date_created", "created", "timestamp"}},
+	{"clicks", "clicks_column", []string{"clicks", "user_clicks", "total_clicks"}},
+}
+
+var importDateFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// importRecord is a parsed row, or why it could not be parsed.
+type importRecord struct {
+	row ImportRow
+	err error
+}
+
+// ImportURLs starts a background job importing links from a csv file (also
+// Bitly exports) or a YOURLS json dump, sent as the body or as the file field
+// of a form. The format parameter is csv, bitly or yourls, guessed from the
+// content type when omitted. The file is parsed before responding, so a
+// malformed one is rejected; the links are added by the job.
+func (h *handler) ImportURLs(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	body := io.Reader(r.Body)
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "multipart/form-data") {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body, contentType = file, header.Header.Get("Content-Type")
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+		if strings.HasPrefix(contentType, "application/json") {
+			format = "yourls"
+		}
+	}
+
+	var records []importRecord
+	var err error
+	switch format {
+	case "csv", "bitly":
+		mapping := make(map[string]string)
+		for _, column := range importColumns {
+			if header := r.URL.Query().Get(column.param); header != "" {
+				mapping[column.field] = header
+			}
+		}
+		records, err = parseCSVImport(body, mapping)
+	case "yourls":
+		records, err = parseYOURLSImport(body)
+	default:
+		http.Error(w, "format must be csv, bitly or yourls", http.StatusBadRequest)
+		return
+	}
+	if err == nil && len(records) == 0 {
+		err = errNoImportRows
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.imports.start(userID, len(records))
+	switch {
+	case errors.Is(err, errTooManyImports):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case errors.Is(err, errImportsShutdown):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	go h.runImport(job, records, userID)
+
+	resp, err := json.Marshal(job.status())
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/api/user/imports/"+job.id)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(resp)
+}
+
+// GetImport reports the progress of an import job of the user.
+func (h *handler) GetImport(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	job := h.imports.get(chi.URLParam(r, "jobID"))
+	if job == nil || job.userID != userID {
+		http.NotFound(w, r)
+		return
+	}
+
+	resp, err := json.Marshal(job.status())
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp)
+}
+
+// runImport adds the links one by one, so a failing row is reported without
+// stopping the rest. Errors other than invalid input are logged and reported
+// as server errors. A job canceled by shutdown stops between rows.
+func (h *handler) runImport(job *importJob, records []importRecord, userID uint32) {
+	defer h.imports.done(job)
+	for _, record := range records {
+		if h.imports.ctx.Err() != nil {
+			job.finish(importCanceled)
+			return
+		}
+		if record.err != nil {
+			job.fail(record.row, record.err.Error())
+			continue
+		}
+		ctx, cancel := context.WithTimeout(h.imports.ctx, 10*time.Second)
+		id, existing, err := h.shortURLService.ImportURL(ctx, record.row, userID)
+		cancel()
+		switch {
+		case errors.Is(err, ErrInvalidURL) || errors.Is(err, db.ErrInvalidLabel):
+			job.fail(record.row, err.Error())
+		case err != nil:
+			log.Println(err)
+			job.fail(record.row, "server error")
+		case existing:
+			job.exist()
+		default:
+			job.create(record.row, id, fmt.Sprintf("%s/%s", h.baseURL, id))
+		}
+	}
+	job.finish(importDone)
+}
+
+func parseCSVImport(r io.Reader, mapping map[string]string) ([]importRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errNoImportRows
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		index[normalizeHeader(name)] = i
+	}
+	columns := make(map[string]int)
+	for _, column := range importColumns {
+		if name, ok := mapping[column.field]; ok {
+			i, ok := index[normalizeHeader(name)]
+			if !ok {
+				return nil, fmt.Errorf("column %q not found", name)
+			}
+			columns[column.field] = i
+			continue
+		}
+		for _, name := range column.headers {
+			if i, ok := index[name]; ok {
+				columns[column.field] = i
+				break
+			}
+		}
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, errNoURLColumn
+	}
+
+	var records []importRecord
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		value := func(field string) string {
+			if i, ok := columns[field]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+		if strings.TrimSpace(strings.Join(fields, "")) == "" {
+			continue
+		}
+		record := importRecord{row: ImportRow{
+			Line:      line,
+			ID:        importID(value("id")),
+			OriginURL: value("url"),
+			Tags:      splitImportTags(value("tags")),
+			Folder:    value("folder"),
+		}}
+		if record.row.CreatedAt, err = parseImportDate(value("created")); err != nil {
+			record.err = fmt.Errorf("invalid created date %q", value("created"))
+		}
+		if clicks := value("clicks"); clicks != "" && record.err == nil {
+			if record.row.Clicks, err = strconv.ParseInt(clicks, 10, 64); err != nil || record.row.Clicks < 0 {
+				record.err = fmt.Errorf("invalid clicks %q", clicks)
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+type yourlsLink struct {
+	Keyword   string      `json:"keyword"`
+	ShortURL  string      `json:"shorturl"`
+	URL       string      `json:"url"`
+	Timestamp string      `json:"timestamp"`
+	Clicks    json.Number `json:"clicks"`
+}
+
+// parseYOURLSImport reads an array of rows of the yourls_url table or the
+// response of the stats API action, whose links are keyed link_1, link_2...
+func parseYOURLSImport(r io.Reader) ([]importRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var links []yourlsLink
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("{")) {
+		var stats struct {
+			Links map[string]yourlsLink `json:"links"`
+		}
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(stats.Links))
+		for key := range stats.Links {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		for _, key := range keys {
+			links = append(links, stats.Links[key])
+		}
+	} else if err := json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+
+	records := make([]importRecord, len(links))
+	for i, link := range links {
+		id := link.Keyword
+		if id == "" {
+			id = importID(link.ShortURL)
+		}
+		record := importRecord{row: ImportRow{Line: i + 1, ID: id, OriginURL: strings.TrimSpace(link.URL)}}
+		if record.row.CreatedAt, err = parseImportDate(link.Timestamp); err != nil {
+			record.err = fmt.Errorf("invalid timestamp %q", link.Timestamp)
+		}
+		if link.Clicks != "" && record.err == nil {
+			if record.row.Clicks, err = link.Clicks.Int64(); err != nil || record.row.Clicks < 0 {
+				record.err = fmt.Errorf("invalid clicks %q", link.Clicks)
+			}
+		}
+		records[i] = record
+	}
+	return records, nil
+}
+
+func normalizeHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// importID takes the ID from a short link such as bit.ly/abc, or returns a
+// bare ID as is.
+func importID(value string) string {
+	value = strings.TrimRight(value, "/")
+	return value[strings.LastIndex(value, "/")+1:]
+}
+
+func splitImportTags(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ';' || r == '|'
+	})
+}
+
+func parseImportDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, layout := range importDateFormats {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// importJobs keeps import jobs in memory, so their status is only known to
+// the instance running them and is lost on restart. Finished jobs are
+// dropped after importJobTTL. At most maxRunningImports jobs run at once,
+// maxUserImports of them for one user.
+type importJobs struct {
+	mu       sync.Mutex
+	jobs     map[string]*importJob
+	running  map[uint32]int
+	total    int
+	shutdown bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newImportJobs() *importJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &importJobs{jobs: make(map[string]*importJob), running: make(map[uint32]int), ctx: ctx, cancel: cancel}
+}
+
+func (j *importJobs) start(userID uint32, total int) (*importJob, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	job := &importJob{
+		id:     hex.EncodeToString(id),
+		userID: userID,
+		resp: RespImportJob{
+			ID:        hex.EncodeToString(id),
+			Status:    importRunning,
+			Total:     total,
+			StartedAt: time.Now(),
+		},
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch {
+	case j.shutdown:
+		return nil, errImportsShutdown
+	case j.total >= maxRunningImports || j.running[userID] >= maxUserImports:
+		return nil, errTooManyImports
+	}
+	for id, old := range j.jobs {
+		if old.expired() {
+			delete(j.jobs, id)
+		}
+	}
+	j.jobs[job.id] = job
+	j.running[userID]++
+	j.total++
+	j.wg.Add(1)
+	return job, nil
+}
+
+func (j *importJobs) done(job *importJob) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running[job.userID]--; j.running[job.userID] == 0 {
+		delete(j.running, job.userID)
+	}
+	j.total--
+	j.wg.Done()
+}
+
+// close refuses new jobs, cancels the running ones and waits for them to
+// stop or for ctx to be done.
+func (j *importJobs) close(ctx context.Context) error {
+	j.mu.Lock()
+	j.shutdown = true
+	j.mu.Unlock()
+	j.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *importJobs) get(id string) *importJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jobs[id]
+}
+
+// importJob counts the outcome of each row. Only the first maxImportReported
+// errors and renamed IDs are listed.
+type importJob struct {
+	id     string
+	userID uint32
+
+	mu   sync.Mutex
+	resp RespImportJob
+}
+
+func (j *importJob) create(row ImportRow, id, shortURL string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.resp.Processed++
+	j.resp.Created++
+	if row.ID != "" && row.ID != id && len(j.resp.Renamed) < maxImportReported {
+		j.resp.Renamed = append(j.resp.Renamed, RespImportRenamed{Line: row.Line, ID: row.ID, ShortURL: shortURL})
+	}
+}
+
+func (j *importJob) exist() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.resp.Processed++
+	j.resp.Existing++
+}
+
+func (j *importJob) fail(row ImportRow, reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.resp.Processed++
+	j.resp.Failed++
+	if len(j.resp.Errors) < maxImportReported {
+		j.resp.Errors = append(j.resp.Errors, RespImportError{Line: row.Line, OriginalURL: row.OriginURL, Error: reason})
+	}
+}
+
+func (j *importJob) finish(status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.resp.Status = status
+	j.resp.FinishedAt = &now
+}
+
+func (j *importJob) expired() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.resp.FinishedAt != nil && time.Since(*j.resp.FinishedAt) > importJobTTL
+}
+
+func (j *importJob) status() RespImportJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	resp := j.resp
+	resp.Errors = append([]RespImportError(nil), j.resp.Errors...)
+	resp.Renamed = append([]RespImportRenamed(nil), j.resp.Renamed...)
+	return resp
+}
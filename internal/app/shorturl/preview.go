@@ -0,0 +1,240 @@
+package shorturl
+
+import (
+	"context"
+	"errors"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"html"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	previewFetchTimeout = 3 * time.Second
+	maxPreviewFetch     = 64 << 10
+	maxPreviewTitle     = 200
+	titleWorkers        = 4
+	titleQueueSize      = 1000
+)
+
+var errPrivateAddress = errors.New("preview of a private address")
+
+// nonPublicNetworks are not covered by the net.IP checks in publicOnly:
+// carrier-grade NAT and "this network".
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("0.0.0.0/8"),
+}
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link to {{.Domain}}</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:3em auto;padding:0 1em}code{word-break:break-all}</style>
+</head>
+<body>
+<p>This link goes to <strong>{{.Domain}}</strong></p>
+{{if .Title}}<h1>{{.Title}}</h1>
+{{end}}<p><code>{{.URL}}</code></p>
+<form action="{{.Continue}}" method="get">
+<input type="hidden" name="continue">
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+type previewData struct {
+	Domain   string
+	URL      string
+	Title    string
+	Continue string
+}
+
+// previewClient only connects to public addresses, so previews cannot be used
+// to probe the internal network, and gives up quickly on slow sites.
+var previewClient = &http.Client{
+	Timeout: previewFetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: previewFetchTimeout, Control: publicOnly}).DialContext,
+	},
+}
+
+// writePreview shows where the link goes, with a button that follows it.
+// The title of the destination is only shown if a TitleFetcher stored it.
+func (h *handler) writePreview(w http.ResponseWriter, r *http.Request, shortURL db.ShortURL) {
+	data := previewData{
+		URL:      shortURL.OriginURL,
+		Title:    shortURL.Title,
+		Continue: h.baseURL + "/" + shortURL.ID,
+	}
+	if destination, err := url.Parse(shortURL.OriginURL); err == nil {
+		data.Domain = destination.Hostname()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := previewPage.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
+
+// TitleFetcher stores the title of the destination of new and edited links
+// in the background, so preview pages need no request to it. Links queued
+// while titleQueueSize links are waiting get no title.
+type TitleFetcher struct {
+	st    db.Storage
+	fetch func(ctx context.Context, url string) string
+	queue chan titleRequest
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type titleRequest struct {
+	id  string
+	url string
+}
+
+func NewTitleFetcher(st db.Storage) *TitleFetcher {
+	return newTitleFetcher(st, fetchTitle)
+}
+
+func newTitleFetcher(st db.Storage, fetch func(ctx context.Context, url string) string) *TitleFetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &TitleFetcher{
+		st:     st,
+		fetch:  fetch,
+		queue:  make(chan titleRequest, titleQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	f.wg.Add(titleWorkers)
+	for i := 0; i < titleWorkers; i++ {
+		go f.run()
+	}
+	return f
+}
+
+func (f *TitleFetcher) Queue(id, url string) {
+	select {
+	case f.queue <- titleRequest{id: id, url: url}:
+	default:
+	}
+}
+
+// Close stops the workers; titles still queued are not fetched.
+func (f *TitleFetcher) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	return nil
+}
+
+func (f *TitleFetcher) run() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case req := <-f.queue:
+			f.store(req)
+		}
+	}
+}
+
+// store skips links edited since they were queued, which queued the new
+// destination themselves. An empty title is stored too, clearing the title
+// of the previous destination.
+func (f *TitleFetcher) store(req titleRequest) {
+	ctx, cancel := context.WithTimeout(f.ctx, 2*previewFetchTimeout)
+	defer cancel()
+	title := f.fetch(ctx, req.url)
+	shortURL, err := f.st.GetByID(ctx, req.id)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Println(err)
+		}
+		return
+	}
+	if shortURL.OriginURL != req.url || shortURL.Title == title {
+		return
+	}
+	if _, err := f.st.SetTitle(ctx, req.id, title); err != nil && !errors.Is(err, db.ErrNotFound) {
+		log.Println(err)
+	}
+}
+
+// fetchTitle returns the title of an HTML page, or nothing if it cannot be
+// read quickly.
+func fetchTitle(ctx context.Context, pageURL string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return ""
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxPreviewFetch))
+	if err != nil {
+		return ""
+	}
+	return pageTitle(page)
+}
+
+func pageTitle(page []byte) string {
+	match := titlePattern.FindSubmatch(page)
+	if match == nil {
+		return ""
+	}
+	title := []rune(strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " "))
+	if len(title) > maxPreviewTitle {
+		return string(title[:maxPreviewTitle]) + "…"
+	}
+	return string(title)
+}
+
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
@@ -2,11 +2,51 @@ package shorturl
 
 import (
 	"context"
+	"errors"
 	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"log"
+	"net/url"
+	"time"
 )
 
+var (
+	ErrForbidden       = errors.New("short url belongs to another user")
+	ErrUnknownRevision = errors.New("revision not found")
+	ErrTagExists       = errors.New("tag already exists")
+	ErrInvalidURL      = errors.New("url is invalid")
+)
+
+// Labels are the tags and folder given when shortening a link.
+type Labels struct {
+	Tags   []string
+	Folder string
+}
+
+func (l Labels) normalize() (Labels, error) {
+	tags, err := db.NormalizeTags(l.Tags)
+	if err != nil {
+		return Labels{}, err
+	}
+	folder, err := db.NormalizeFolder(l.Folder)
+	return Labels{Tags: tags, Folder: folder}, err
+}
+
+const (
+	maxCustomIDLength = 32
+)
+
+type clickRecorder interface {
+	Record(id string)
+}
+
+type titleQueue interface {
+	Queue(id, url string)
+}
+
 type Service struct {
 	storage db.Storage
+	clicks  clickRecorder
+	titles  titleQueue
 }
 
 func NewService(st db.Storage) *Service {
@@ -15,19 +55,232 @@ func NewService(st db.Storage) *Service {
 	}
 }
 
-func (s *Service) Add(ctx context.Context, originURL string, userID uint32) (string, error) {
-	newID, err := s.storage.Add(ctx, originURL, userID)
-	return newID, err
+// Add shortens originURL. Labels are checked first and stored together with
+// the link, through a batch of one when there are any.
+func (s *Service) Add(ctx context.Context, originURL string, userID uint32, labels Labels) (string, error) {
+	labels, err := labels.normalize()
+	if err != nil {
+		return "", err
+	}
+	if labels.Tags == nil && labels.Folder == "" {
+		id, err := s.storage.Add(ctx, originURL, userID)
+		if err == nil {
+			s.queueTitle(id, originURL)
+		}
+		return id, err
+	}
+	urls, err := s.storage.AddBatchURL(ctx, []db.ShortURL{{OriginURL: originURL, Tags: labels.Tags, Folder: labels.Folder}}, userID)
+	if err != nil {
+		return "", err
+	}
+	s.queueTitle(urls[0].ID, originURL)
+	return urls[0].ID, nil
 }
 
+// AddBatchURL shortens urls together with the tags and folders they carry.
 func (s *Service) AddBatchURL(ctx context.Context, urls []db.ShortURL, userID uint32) ([]db.ShortURL, error) {
-	return s.storage.AddBatchURL(ctx, urls, userID)
+	for index, url := range urls {
+		labels, err := Labels{Tags: url.Tags, Folder: url.Folder}.normalize()
+		if err != nil {
+			return nil, err
+		}
+		urls[index].Tags, urls[index].Folder = labels.Tags, labels.Folder
+	}
+	urls, err := s.storage.AddBatchURL(ctx, urls, userID)
+	for _, url := range urls {
+		s.queueTitle(url.ID, url.OriginURL)
+	}
+	return urls, err
+}
+
+// ImportRow is a link read from another shortener's export. Line locates it
+// in the file for the error report.
+type ImportRow struct {
+	Line      int
+	ID        string
+	OriginURL string
+	Tags      []string
+	Folder    string
+	CreatedAt time.Time
+	Clicks    int64
+}
+
+// ImportURL adds an imported link, keeping its ID when it is valid and free
+// and generating one otherwise. A destination that is already shortened is
+// not added again; its ID is returned with existing set.
+func (s *Service) ImportURL(ctx context.Context, row ImportRow, userID uint32) (id string, existing bool, err error) {
+	if _, err := url.ParseRequestURI(row.OriginURL); err != nil {
+		return "", false, ErrInvalidURL
+	}
+	labels, err := Labels{Tags: row.Tags, Folder: row.Folder}.normalize()
+	if err != nil {
+		return "", false, err
+	}
+	link := db.ShortURL{
+		ID:        row.ID,
+		OriginURL: row.OriginURL,
+		UserID:    userID,
+		CreatedAt: row.CreatedAt,
+		Tags:      labels.Tags,
+		Folder:    labels.Folder,
+		Clicks:    row.Clicks,
+	}
+
+	id, err = s.storage.GetByOriginalURL(ctx, row.OriginURL)
+	if err == nil {
+		return id, true, nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return "", false, err
+	}
+	err = db.ErrIDTaken
+	if validCustomID(row.ID) {
+		err = s.storage.Insert(ctx, link)
+	}
+	if errors.Is(err, db.ErrIDTaken) {
+		link.ID, err = s.storage.Add(ctx, row.OriginURL, userID)
+		if err == nil && (!row.CreatedAt.IsZero() || row.Clicks != 0 || labels.Tags != nil || labels.Folder != "") {
+			err = s.storage.Save(ctx, link)
+		}
+	}
+	if errors.Is(err, db.ErrConflict) {
+		id, err = s.storage.GetByOriginalURL(ctx, row.OriginURL)
+		return id, true, err
+	}
+	if err != nil {
+		return "", false, err
+	}
+	s.queueTitle(link.ID, row.OriginURL)
+	return link.ID, false, nil
+}
+
+// validCustomID accepts IDs that are safe in a path without escaping.
+func validCustomID(id string) bool {
+	if id == "" || len(id) > maxCustomIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	BatchCreated  = "created"
+	BatchExisting = "existing"
+	BatchInvalid  = "invalid"
+)
+
+// BatchResult is the outcome for one link of a partial batch. Reason says
+// why an invalid link was rejected.
+type BatchResult struct {
+	db.ShortURL
+	Status string
+	Reason string
+}
+
+// AddBatchPartial shortens the valid links of urls and reports on each link
+// separately. Invalid links are skipped. Destinations that are already
+// shortened, or repeat an earlier link of the batch, get the existing ID. If
+// another request adds one of the links meanwhile, the batch is retried link
+// by link. Storages without transactions may have added some links before
+// the conflict; as none of the links existed before, those the user holds
+// now are reported as created.
+func (s *Service) AddBatchPartial(ctx context.Context, urls []db.ShortURL, userID uint32) ([]BatchResult, error) {
+	results := make([]BatchResult, len(urls))
+	first := make(map[string]int, len(urls))
+	var pending []db.ShortURL
+	var pendingIndex []int
+	for index, link := range urls {
+		results[index].ShortURL = link
+		if _, err := url.ParseRequestURI(link.OriginURL); err != nil {
+			results[index].Status, results[index].Reason = BatchInvalid, ErrInvalidURL.Error()
+			continue
+		}
+		if _, err := (Labels{Tags: link.Tags, Folder: link.Folder}).normalize(); err != nil {
+			results[index].Status, results[index].Reason = BatchInvalid, err.Error()
+			continue
+		}
+		if _, ok := first[link.OriginURL]; ok {
+			continue
+		}
+		first[link.OriginURL] = index
+
+		id, err := s.storage.GetByOriginalURL(ctx, link.OriginURL)
+		switch {
+		case err == nil:
+			results[index].ID, results[index].Status = id, BatchExisting
+		case errors.Is(err, db.ErrNotFound):
+			pending = append(pending, link)
+			pendingIndex = append(pendingIndex, index)
+		default:
+			return nil, err
+		}
+	}
+
+	created, err := s.AddBatchURL(ctx, pending, userID)
+	switch {
+	case err == nil:
+		for i, link := range created {
+			results[pendingIndex[i]].ID, results[pendingIndex[i]].Status = link.ID, BatchCreated
+		}
+	case errors.Is(err, db.ErrConflict):
+		for _, index := range pendingIndex {
+			link := results[index]
+			status := BatchCreated
+			id, err := s.Add(ctx, link.OriginURL, userID, Labels{Tags: link.Tags, Folder: link.Folder})
+			if errors.Is(err, db.ErrConflict) {
+				status, id, err = s.batchHolder(ctx, link.OriginURL, userID)
+			}
+			if err != nil {
+				return nil, err
+			}
+			results[index].ID, results[index].Status = id, status
+		}
+	default:
+		return nil, err
+	}
+
+	for index, link := range urls {
+		if results[index].Status == "" {
+			results[index].ID, results[index].Status = results[first[link.OriginURL]].ID, BatchExisting
+		}
+	}
+	return results, nil
+}
+
+// batchHolder finds the link that kept a partial batch from adding url.
+func (s *Service) batchHolder(ctx context.Context, url string, userID uint32) (string, string, error) {
+	id, err := s.storage.GetByOriginalURL(ctx, url)
+	if err != nil {
+		return "", "", err
+	}
+	holder, err := s.storage.GetByID(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	if holder.UserID == userID {
+		s.queueTitle(id, url)
+		return BatchCreated, id, nil
+	}
+	return BatchExisting, id, nil
 }
 
 func (s *Service) GetURLsByUserID(ctx context.Context, userID uint32) ([]db.ShortURL, error) {
 	return s.storage.GetURLsByUserID(ctx, userID)
 }
 
+func (s *Service) ListURLs(ctx context.Context, q db.URLQuery) (db.URLPage, error) {
+	tags, err := db.NormalizeTags(q.Tags)
+	if err != nil {
+		return db.URLPage{}, err
+	}
+	q.Tags = tags
+	return s.storage.ListURLs(ctx, q)
+}
+
 func (s *Service) GetByOriginalURL(ctx context.Context, url string) (string, error) {
 	return s.storage.GetByOriginalURL(ctx, url)
 }
@@ -35,3 +288,174 @@ func (s *Service) GetByOriginalURL(ctx context.Context, url string) (string, err
 func (s *Service) GetByID(ctx context.Context, idURL string) (db.ShortURL, error) {
 	return s.storage.GetByID(ctx, idURL)
 }
+
+// SetClickBuffer makes CountClick count clicks in buffer instead of writing
+// each one to the storage.
+func (s *Service) SetClickBuffer(buffer *db.ClickBuffer) {
+	s.clicks = buffer
+}
+
+// CountClick counts a redirect through the link. Failures are only logged,
+// as they should not keep the redirect from happening.
+func (s *Service) CountClick(ctx context.Context, idURL string) {
+	if s.clicks != nil {
+		s.clicks.Record(idURL)
+	} else if err := s.storage.AddClicks(ctx, map[string]int64{idURL: 1}); err != nil {
+		log.Println(err)
+	}
+}
+
+// SetTitleFetcher makes fetcher store the page title of new and edited links
+// for their preview page.
+func (s *Service) SetTitleFetcher(fetcher *TitleFetcher) {
+	s.titles = fetcher
+}
+
+func (s *Service) queueTitle(idURL, originURL string) {
+	if s.titles != nil {
+		s.titles.Queue(idURL, originURL)
+	}
+}
+
+// ExportURLs calls fn for every link of the user, oldest first.
+func (s *Service) ExportURLs(ctx context.Context, userID uint32, fn func(url db.ShortURL) error) error {
+	return s.storage.IterateUser(ctx, userID, fn)
+}
+
+func (s *Service) UpdateURL(ctx context.Context, idURL, originURL string, userID uint32) (db.ShortURL, error) {
+	if _, err := s.owned(ctx, idURL, userID); err != nil {
+		return db.ShortURL{}, err
+	}
+	return s.edit(ctx, idURL, originURL, userID)
+}
+
+func (s *Service) edit(ctx context.Context, idURL, originURL string, userID uint32) (db.ShortURL, error) {
+	shortURL, err := s.storage.UpdateURL(ctx, idURL, originURL, userID)
+	if err == nil {
+		s.queueTitle(idURL, originURL)
+	}
+	return shortURL, err
+}
+
+func (s *Service) GetHistory(ctx context.Context, idURL string, userID uint32) ([]db.Revision, error) {
+	if _, err := s.owned(ctx, idURL, userID); err != nil {
+		return nil, err
+	}
+	return s.storage.GetHistory(ctx, idURL)
+}
+
+// UpdateLabels replaces the tags or the folder of a link; a nil argument
+// leaves that label as it is.
+func (s *Service) UpdateLabels(ctx context.Context, idURL string, tags *[]string, folder *string, userID uint32) (db.ShortURL, error) {
+	shortURL, err := s.owned(ctx, idURL, userID)
+	if err != nil {
+		return db.ShortURL{}, err
+	}
+	if tags != nil {
+		if shortURL.Tags, err = db.NormalizeTags(*tags); err != nil {
+			return db.ShortURL{}, err
+		}
+	}
+	if folder != nil {
+		if shortURL.Folder, err = db.NormalizeFolder(*folder); err != nil {
+			return db.ShortURL{}, err
+		}
+	}
+	return s.storage.SetLabels(ctx, idURL, shortURL.Tags, shortURL.Folder)
+}
+
+func (s *Service) ListTags(ctx context.Context, userID uint32) ([]db.TagCount, error) {
+	return s.storage.ListTags(ctx, userID)
+}
+
+// RenameTag renames one of the user's tags and returns the number of links
+// changed. Renaming onto an existing tag fails with ErrTagExists; use
+// MergeTags for that.
+func (s *Service) RenameTag(ctx context.Context, userID uint32, from, to string) (int, error) {
+	from, err := db.NormalizeTag(from)
+	if err != nil {
+		return 0, err
+	}
+	if to, err = db.NormalizeTag(to); err != nil {
+		return 0, err
+	}
+	tags, err := s.storage.ListTags(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	found := false
+	for _, tag := range tags {
+		if tag.Tag == to && to != from {
+			return 0, ErrTagExists
+		}
+		found = found || tag.Tag == from
+	}
+	if !found {
+		return 0, db.ErrNotFound
+	}
+	if from == to {
+		return 0, nil
+	}
+	ids, err := s.storage.RenameTag(ctx, userID, from, to)
+	return len(ids), err
+}
+
+// MergeTags moves the user's links from every tag in tags to into and
+// returns the number of links changed.
+func (s *Service) MergeTags(ctx context.Context, userID uint32, tags []string, into string) (int, error) {
+	tags, err := db.NormalizeTags(tags)
+	if err != nil {
+		return 0, err
+	}
+	if into, err = db.NormalizeTag(into); err != nil {
+		return 0, err
+	}
+	changed := make(map[string]struct{})
+	for _, tag := range tags {
+		if tag == into {
+			continue
+		}
+		ids, err := s.storage.RenameTag(ctx, userID, tag, into)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range ids {
+			changed[id] = struct{}{}
+		}
+	}
+	return len(changed), nil
+}
+
+// Rollback points the link back at the destination it had before the given
+// revision. The rollback is an edit itself, so it can be undone the same way.
+func (s *Service) Rollback(ctx context.Context, idURL string, version int, userID uint32) (db.ShortURL, error) {
+	revs, err := s.GetHistory(ctx, idURL, userID)
+	if err != nil {
+		return db.ShortURL{}, err
+	}
+	for _, rev := range revs {
+		if rev.Version == version {
+			return s.edit(ctx, idURL, rev.OriginURL, userID)
+		}
+	}
+	return db.ShortURL{}, ErrUnknownRevision
+}
+
+// SetPreview turns the preview page shown before redirecting on or off.
+func (s *Service) SetPreview(ctx context.Context, idURL string, preview bool, userID uint32) (db.ShortURL, error) {
+	if _, err := s.owned(ctx, idURL, userID); err != nil {
+		return db.ShortURL{}, err
+	}
+	return s.storage.SetPreview(ctx, idURL, preview)
+}
+
+func (s *Service) owned(ctx context.Context, idURL string, userID uint32) (db.ShortURL, error) {
+	shortURL, err := s.storage.GetByID(ctx, idURL)
+	if err != nil {
+		return shortURL, err
+	}
+	if shortURL.UserID != userID {
+		return shortURL, ErrForbidden
+	}
+	return shortURL, nil
+}
@@ -0,0 +1,122 @@
+package shorturl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Vrg26/shortener-tpl/internal/app/shorturl/db"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	streamChunkSize = 500
+	maxStreamLine   = 64 << 10
+)
+
+// AddBatchStream reads RequestBatchURL lines of NDJSON and streams back a
+// ResponseBatchURL line for each, as in partial batches. Lines are added in
+// chunks of up to streamChunkSize, cut short whenever no more input has
+// arrived yet, so a client waiting for answers gets them. The body is read
+// only after the results of a chunk are written, so a client that stops
+// reading responses stops the upload too.
+func (h *handler) AddBatchStream(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(uint32)
+
+	if !ok {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := enableFullDuplex(w); err != nil && r.ProtoMajor < 2 {
+		http.Error(w, "streaming needs HTTP/2 on this server", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	reader := bufio.NewReaderSize(r.Body, maxStreamLine)
+
+	var chunk []db.ShortURL
+	flush := func() error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if len(chunk) > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			results, err := h.shortURLService.AddBatchPartial(ctx, chunk, userID)
+			cancel()
+			if err != nil {
+				return err
+			}
+			for _, result := range results {
+				if err := enc.Encode(h.batchResponse(result)); err != nil {
+					return err
+				}
+			}
+			chunk = chunk[:0]
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	invalid := func(line int, reason string) error {
+		if err := flush(); err != nil {
+			return err
+		}
+		return enc.Encode(ResponseBatchURL{Status: BatchInvalid, Reason: fmt.Sprintf("line %d: %s", line, reason)})
+	}
+
+	for line := 1; ; line++ {
+		data, tooLong, err := readLine(reader)
+		if err != nil && err != io.EOF {
+			if r.Context().Err() == nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		var reqURL RequestBatchURL
+		var lineErr error
+		switch data = bytes.TrimSpace(data); {
+		case tooLong:
+			lineErr = invalid(line, "line too long")
+		case len(data) == 0:
+		case json.Unmarshal(data, &reqURL) != nil:
+			lineErr = invalid(line, "invalid json")
+		default:
+			chunk = append(chunk, batchLink(reqURL))
+		}
+		if lineErr == nil && (err == io.EOF || len(chunk) >= streamChunkSize || reader.Buffered() == 0) {
+			lineErr = flush()
+		}
+		if lineErr != nil {
+			if r.Context().Err() == nil {
+				log.Println(lineErr)
+			}
+			return
+		}
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// readLine returns the next line, or reports that it did not fit in the
+// reader's buffer and skips it.
+func readLine(r *bufio.Reader) ([]byte, bool, error) {
+	line, err := r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, false, err
+	}
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+	return nil, true, err
+}
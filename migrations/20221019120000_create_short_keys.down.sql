@@ -0,0 +1 @@
+DROP TABLE short_keys;
\ No newline at end of file
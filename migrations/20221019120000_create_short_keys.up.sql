@@ -0,0 +1,3 @@
+CREATE TABLE short_keys (
+                      id varchar(250) not null primary key
+);
\ No newline at end of file
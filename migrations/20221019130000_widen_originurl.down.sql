@@ -0,0 +1 @@
+ALTER TABLE urls ALTER COLUMN originUrl TYPE varchar(2100);
\ No newline at end of file
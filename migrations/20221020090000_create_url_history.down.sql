@@ -0,0 +1 @@
+DROP TABLE url_history;
\ No newline at end of file
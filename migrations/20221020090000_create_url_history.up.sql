@@ -0,0 +1,10 @@
+CREATE TABLE url_history (
+                      id bigserial not null primary key,
+                      shortUrl varchar(250) not null,
+                      version integer not null,
+                      originUrl varchar(4096) not null,
+                      editorId bigint,
+                      edited_on TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX url_history_version_idx ON url_history (shortUrl, version)
\ No newline at end of file
@@ -0,0 +1 @@
+DROP INDEX urls_user_created_idx;
\ No newline at end of file
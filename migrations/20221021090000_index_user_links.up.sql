@@ -0,0 +1 @@
+CREATE INDEX urls_user_created_idx ON urls (userId, created_on, shortUrl);
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP TABLE url_tags;
+
+DROP INDEX urls_user_folder_idx;
+
+ALTER TABLE urls DROP COLUMN folder
\ No newline at end of file
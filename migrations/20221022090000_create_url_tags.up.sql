@@ -0,0 +1,12 @@
+ALTER TABLE urls ADD COLUMN folder varchar(128) not null default '';
+
+CREATE INDEX urls_user_folder_idx ON urls (userId, folder);
+
+CREATE TABLE url_tags (
+                      shortUrl varchar(250) not null,
+                      userId bigint not null,
+                      tag varchar(64) not null,
+                      primary key (shortUrl, tag)
+);
+
+CREATE INDEX url_tags_user_tag_idx ON url_tags (userId, tag)
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE urls DROP COLUMN clicks
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN clicks bigint not null default 0
\ No newline at end of file
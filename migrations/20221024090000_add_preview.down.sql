@@ -0,0 +1 @@
+ALTER TABLE urls DROP COLUMN preview
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN preview boolean not null default false
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP INDEX url_index_idx;
+ALTER TABLE urls DROP COLUMN url_index;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE urls ADD COLUMN url_index varchar(64);
+CREATE UNIQUE INDEX url_index_idx ON urls (url_index);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE urls DROP COLUMN title
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN title text not null default ''
\ No newline at end of file